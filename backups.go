@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// backupTimeFormat is the timestamp layout used in the names of the backups
+const backupTimeFormat = "20060102150405"
+
+// backupKinds maps the extension of a backup object to what created it
+var backupKinds = map[string]string{
+	".sqldump": "pg_dump",
+	".enc":     "pg_basebackup",
+	".archive": "mongo_dump",
+	".bup":     "es_backup",
+	".tpl":     "es_backup_templates",
+	".c4gh":    "backup_bucket",
+}
+
+// timestampedName matches the `YYYYMMDDhhmmss-<source>` naming of the dumps
+var timestampedName = regexp.MustCompile(`^(\d{14})-(.+)$`)
+
+// partialBackupSuffix is added to the index name of Elasticsearch backups
+// that only hold the documents matching a query, followed by a timestamp
+const partialBackupSuffix = ".partial-"
+
+// partialBackupName matches the `<index>.partial-YYYYMMDDhhmmss` naming of
+// partial Elasticsearch backups
+var partialBackupName = regexp.MustCompile(`^(.+\.partial)-(\d{14})$`)
+
+// partObjectName matches the `<backup>.bup.part-NNN` naming of the objects
+// holding the slices of an Elasticsearch backup exported in parallel
+var partObjectName = regexp.MustCompile(`^(.+\.bup)\.part-\d+$`)
+
+// backupEntry describes a backup object found in the bucket
+type backupEntry struct {
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+	Size      int64     `json:"size"`
+	Manifest  bool      `json:"manifest"`
+	// Parts lists the part objects of the backup, Size includes them
+	Parts []string `json:"parts,omitempty"`
+	// partManifests lists the manifests of the part objects
+	partManifests []string
+}
+
+// parseBackupName extracts the kind, source and timestamp of a backup from
+// its object name. Names without a timestamp get the time the object was
+// last modified. The last return value is false for objects that are not
+// backups.
+func parseBackupName(key string, modified time.Time) (backupEntry, bool) {
+	ext := path.Ext(key)
+	if _, ok := backupKinds[ext]; !ok {
+		return backupEntry{}, false
+	}
+
+	entry := backupEntry{Name: key, Kind: strings.TrimPrefix(ext, "."), Timestamp: modified}
+	base := strings.TrimSuffix(key, ext)
+
+	switch ext {
+	case ".c4gh":
+		// encrypted bucket objects are grouped by the path they belong to
+		entry.Source = path.Dir(base)
+	case ".bup":
+		entry.Source = base
+		// partial backups of an index are grouped apart from its full backups
+		if m := partialBackupName.FindStringSubmatch(base); m != nil {
+			if ts, err := time.ParseInLocation(backupTimeFormat, m[2], time.Local); err == nil {
+				entry.Timestamp = ts
+				entry.Source = m[1]
+			}
+		}
+	default:
+		entry.Source = base
+		if m := timestampedName.FindStringSubmatch(path.Base(base)); m != nil {
+			if ts, err := time.ParseInLocation(backupTimeFormat, m[1], time.Local); err == nil {
+				entry.Timestamp = ts
+				entry.Source = m[2]
+			}
+		}
+	}
+
+	return entry, true
+}
+
+// listBackups returns all backups found under the PathPrefix of the bucket,
+// sorted by kind and source, with the newest backup first. Part objects are
+// attached to the backup they belong to.
+func listBackups(sb *s3Backend) ([]backupEntry, error) {
+	var backups []backupEntry
+	manifests := make(map[string]bool)
+	parts := make(map[string][]string)
+	partSizes := make(map[string]int64)
+
+	err := sb.walkBucket(func(obj *s3.Object) error {
+		if strings.HasSuffix(*obj.Key, manifestSuffix) {
+			manifests[strings.TrimSuffix(*obj.Key, manifestSuffix)] = true
+
+			return nil
+		}
+
+		if m := partObjectName.FindStringSubmatch(*obj.Key); m != nil {
+			parts[m[1]] = append(parts[m[1]], *obj.Key)
+			partSizes[m[1]] += aws.Int64Value(obj.Size)
+
+			return nil
+		}
+
+		entry, ok := parseBackupName(*obj.Key, aws.TimeValue(obj.LastModified))
+		if !ok {
+			return nil
+		}
+		entry.Size = aws.Int64Value(obj.Size)
+		backups = append(backups, entry)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range backups {
+		backups[i].Manifest = manifests[backups[i].Name]
+		backups[i].Parts = parts[backups[i].Name]
+		backups[i].Size += partSizes[backups[i].Name]
+		for _, part := range backups[i].Parts {
+			if manifests[part] {
+				backups[i].partManifests = append(backups[i].partManifests, part+manifestSuffix)
+			}
+		}
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Kind != backups[j].Kind {
+			return backups[i].Kind < backups[j].Kind
+		}
+		if backups[i].Source != backups[j].Source {
+			return backups[i].Source < backups[j].Source
+		}
+
+		return backups[i].Timestamp.After(backups[j].Timestamp)
+	})
+
+	return backups, nil
+}
+
+// printBackups writes the backups as either a table or JSON
+func printBackups(w io.Writer, backups []backupEntry, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(backups)
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tSOURCE\tTIMESTAMP\tSIZE\tPARTS\tMANIFEST\tNAME")
+		for _, b := range backups {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%t\t%s\n",
+				b.Kind, b.Source, b.Timestamp.Format(time.RFC3339), formatBytes(b.Size), len(b.Parts), b.Manifest, b.Name)
+		}
+
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// formatBytes returns a human readable size
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// parseBackupTime parses a timestamp given either in the layout used in the
+// backup names or as RFC3339.
+func parseBackupTime(value string) (time.Time, error) {
+	if ts, err := time.ParseInLocation(backupTimeFormat, value, time.Local); err == nil {
+		return ts, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp %q is neither YYYYMMDDhhmmss nor RFC3339", value)
+	}
+
+	return ts, nil
+}
+
+// resolveBackupName returns the object name to restore. Unless name is
+// "latest" it is returned as is, otherwise the newest backup with the given
+// extension for source is selected, limited to backups taken before the
+// before timestamp when that is set. An empty source matches all backups of
+// the kind.
+func resolveBackupName(sb *s3Backend, name, before, ext, source string) (string, error) {
+	if name != "latest" {
+		if before != "" {
+			return "", fmt.Errorf("--before can only be used together with --name latest")
+		}
+
+		return name, nil
+	}
+
+	var limit time.Time
+	if before != "" {
+		var err error
+		if limit, err = parseBackupTime(before); err != nil {
+			return "", err
+		}
+	}
+
+	backups, err := listBackups(sb)
+	if err != nil {
+		return "", fmt.Errorf("could not list backups: %s", err)
+	}
+
+	var selected *backupEntry
+	for i, b := range backups {
+		if b.Kind != strings.TrimPrefix(ext, ".") || (source != "" && b.Source != source) {
+			continue
+		}
+		if !limit.IsZero() && !b.Timestamp.Before(limit) {
+			continue
+		}
+		if selected == nil || b.Timestamp.After(selected.Timestamp) {
+			selected = &backups[i]
+		}
+	}
+
+	if selected == nil {
+		return "", fmt.Errorf("no %s backup found for %q", ext, source)
+	}
+	log.Infof("Selected backup %s from %s", selected.Name, selected.Timestamp.Format(time.RFC3339))
+
+	return selected.Name, nil
+}
@@ -14,6 +14,10 @@ import (
 type ClFlags struct {
 	name   string
 	action string
+	format string
+	before string
+	index  string
+	dryRun bool
 }
 
 // Config is a parent object for all the different configuration parts
@@ -22,11 +26,13 @@ type Config struct {
 	elastic        elasticConfig
 	mongo          mongoConfig
 	s3             S3Config
-	publicKeyPath  string
-	privateKeyPath string
-	c4ghPassword   string
+	publicKeyPaths []string
+	privateKeys    keySource
+	signingKeyPath string
 	s3Source       S3Config
 	s3Destination  S3Config
+	sync           syncConfig
+	retention      retentionConfig
 }
 
 // NewConfig initializes and parses the config file and/or environment using
@@ -45,6 +51,10 @@ func getCLflags() ClFlags {
 
 	flag.String("action", "backup", "action can be create, backup or restore")
 	flag.String("name", "", "file name to create, backup or restore")
+	flag.String("format", "table", "output format of list_backups, table or json")
+	flag.String("before", "", "with --name latest, restore the newest backup taken before this time")
+	flag.String("index", "", "index es_restore --name latest restores the newest backup of, or glob of the indices es_snapshot_restore restores")
+	flag.Bool("dry-run", false, "only list what prune would delete")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
@@ -55,8 +65,12 @@ func getCLflags() ClFlags {
 
 	action := viper.GetString("action")
 	name := viper.GetString("name")
+	format := viper.GetString("format")
+	before := viper.GetString("before")
+	index := viper.GetString("index")
+	dryRun := viper.GetBool("dry-run")
 
-	return ClFlags{name: name, action: action}
+	return ClFlags{name: name, action: action, format: format, before: before, index: index, dryRun: dryRun}
 
 }
 
@@ -69,6 +83,7 @@ func configS3Storage(prefix string) S3Config {
 	s3.Bucket = viper.GetString(prefix + ".bucket")
 	s3.Port = 443
 	s3.Region = "us-east-1"
+	s3.Workers = 4
 
 	if viper.IsSet(prefix + ".port") {
 		s3.Port = viper.GetInt(prefix + ".port")
@@ -90,6 +105,10 @@ func configS3Storage(prefix string) S3Config {
 		s3.PathPrefix = viper.GetString(prefix + ".PathPrefix")
 	}
 
+	if viper.IsSet(prefix + ".workers") {
+		s3.Workers = viper.GetInt(prefix + ".workers")
+	}
+
 	return s3
 }
 
@@ -110,6 +129,57 @@ func configElastic() elasticConfig {
 	if viper.IsSet("elastic.cacert") {
 		elastic.caCert = viper.GetString("elastic.cacert")
 	}
+	if viper.IsSet("elastic.restoreMode") {
+		elastic.restoreMode = viper.GetString("elastic.restoreMode")
+	}
+	if viper.IsSet("elastic.pagination") {
+		elastic.pagination = viper.GetString("elastic.pagination")
+	}
+	if viper.IsSet("elastic.keepAlive") {
+		elastic.keepAlive = viper.GetDuration("elastic.keepAlive")
+	}
+	if viper.IsSet("elastic.slices") {
+		elastic.slices = viper.GetInt("elastic.slices")
+	}
+	if viper.IsSet("elastic.parts") {
+		elastic.parts = viper.GetInt("elastic.parts")
+	}
+	if viper.IsSet("elastic.bulkWorkers") {
+		elastic.bulkWorkers = viper.GetInt("elastic.bulkWorkers")
+	}
+	if viper.IsSet("elastic.bulkFlushBytes") {
+		elastic.bulkFlushBytes = viper.GetInt("elastic.bulkFlushBytes")
+	}
+	if viper.IsSet("elastic.query") {
+		elastic.query = viper.GetString("elastic.query")
+	}
+	if viper.IsSet("elastic.timeField") {
+		elastic.timeField = viper.GetString("elastic.timeField")
+	}
+	if viper.IsSet("elastic.since") {
+		elastic.since = viper.GetDuration("elastic.since")
+	}
+	if viper.IsSet("elastic.until") {
+		elastic.until = viper.GetDuration("elastic.until")
+	}
+	if viper.IsSet("elastic.snapshot.repository") {
+		elastic.snapshotRepository = viper.GetString("elastic.snapshot.repository")
+	}
+	if viper.IsSet("elastic.snapshot.client") {
+		elastic.snapshotClient = viper.GetString("elastic.snapshot.client")
+	}
+	if viper.IsSet("elastic.snapshot.basePath") {
+		elastic.snapshotBasePath = viper.GetString("elastic.snapshot.basePath")
+	}
+	if viper.IsSet("elastic.restoreIndex") {
+		elastic.restoreIndex = viper.GetString("elastic.restoreIndex")
+	}
+	if viper.IsSet("elastic.restoreSuffix") {
+		elastic.restoreSuffix = viper.GetString("elastic.restoreSuffix")
+	}
+	if viper.IsSet("elastic.restoreAlias") {
+		elastic.restoreAlias = viper.GetString("elastic.restoreAlias")
+	}
 
 	return elastic
 }
@@ -175,6 +245,10 @@ func configMongoDB() mongoConfig {
 		}
 	}
 
+	if viper.IsSet("mongo.database") {
+		mongo.database = viper.GetString("mongo.database")
+	}
+
 	if viper.IsSet("mongo.replicaSet") {
 		mongo.replicaSet = viper.GetString("mongo.replicaSet")
 	}
@@ -182,6 +256,39 @@ func configMongoDB() mongoConfig {
 	return mongo
 }
 
+// configRetention populates the retention policies, a policy set for a
+// single source inherits the values it does not set from its kind.
+func configRetention() retentionConfig {
+	policies := retentionConfig{}
+	for kind := range viper.GetStringMap("retention") {
+		prefix := "retention." + kind
+		policy := readRetentionPolicy(prefix, retentionPolicy{})
+		policies[kind] = policy
+
+		for source := range viper.GetStringMap(prefix + ".sources") {
+			policies[kind+"/"+source] = readRetentionPolicy(prefix+".sources."+source, policy)
+		}
+	}
+
+	return policies
+}
+
+func readRetentionPolicy(prefix string, policy retentionPolicy) retentionPolicy {
+	if viper.IsSet(prefix + ".daily") {
+		policy.daily = viper.GetInt(prefix + ".daily")
+	}
+
+	if viper.IsSet(prefix + ".weekly") {
+		policy.weekly = viper.GetInt(prefix + ".weekly")
+	}
+
+	if viper.IsSet(prefix + ".monthly") {
+		policy.monthly = viper.GetInt(prefix + ".monthly")
+	}
+
+	return policy
+}
+
 func (c *Config) readConfig() {
 	if viper.IsSet("s3.url") {
 		c.s3 = configS3Storage("s3")
@@ -192,17 +299,34 @@ func (c *Config) readConfig() {
 		c.s3Destination = configS3Storage("destination")
 	}
 
+	if viper.IsSet("sync.compare") {
+		c.sync.compare = viper.GetString("sync.compare")
+	}
+
+	if viper.IsSet("sync.mirror") {
+		c.sync.mirror = viper.GetBool("sync.mirror")
+	}
+
 	c.db = configPostgres()
 
 	c.mongo = configMongoDB()
 
 	c.elastic = configElastic()
 
-	c.publicKeyPath = viper.GetString("crypt4ghPublicKey")
+	c.retention = configRetention()
+
+	// backups are encrypted to every key in crypt4ghPublicKeys, as well as to
+	// crypt4ghPublicKey, any one of them can decrypt the backup
+	if viper.IsSet("crypt4ghPublicKey") {
+		c.publicKeyPaths = append(c.publicKeyPaths, viper.GetString("crypt4ghPublicKey"))
+	}
+	c.publicKeyPaths = append(c.publicKeyPaths, viper.GetStringSlice("crypt4ghPublicKeys")...)
 
-	c.privateKeyPath = viper.GetString("crypt4ghPrivateKey")
+	c.privateKeys = configKeySource()
 
-	c.c4ghPassword = viper.GetString("crypt4ghPassphrase")
+	if viper.IsSet("manifestSigningKey") {
+		c.signingKeyPath = viper.GetString("manifestSigningKey")
+	}
 
 	if viper.IsSet("loglevel") {
 		stringLevel := viper.GetString("loglevel")
@@ -216,6 +340,43 @@ func (c *Config) readConfig() {
 	}
 }
 
+// configKeySource returns the source of the crypt4gh private key, by
+// default the file in crypt4ghPrivateKey
+func configKeySource() keySource {
+	pass := passphrase{
+		value: viper.GetString("crypt4ghPassphrase"),
+		file:  viper.GetString("crypt4ghPassphraseFile"),
+	}
+
+	switch source := viper.GetString("privateKeySource.type"); source {
+	case "", "file":
+		return fileKeySource{path: viper.GetString("crypt4ghPrivateKey"), passphrase: pass}
+	case "env":
+		variable := "CRYPT4GH_PRIVATE_KEY"
+		if viper.IsSet("privateKeySource.env") {
+			variable = viper.GetString("privateKeySource.env")
+		}
+
+		return envKeySource{variable: variable, passphrase: pass}
+	case "http":
+		if !viper.IsSet("privateKeySource.url") {
+			log.Fatalln("privateKeySource.url is required for the http private key source")
+		}
+
+		return httpKeySource{
+			url:        viper.GetString("privateKeySource.url"),
+			socket:     viper.GetString("privateKeySource.socket"),
+			tokenFile:  viper.GetString("privateKeySource.tokenFile"),
+			field:      viper.GetString("privateKeySource.field"),
+			passphrase: pass,
+		}
+	default:
+		log.Fatalf("unknown private key source: %s", source)
+	}
+
+	return nil
+}
+
 func parseConfig() {
 	viper.SetConfigName("config")
 	viper.AddConfigPath(".")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -21,11 +22,15 @@ func generatePrivateKey() (*[32]byte, error) {
 	return &privateKey, nil
 }
 
-// Function for getting the public key which is given in the config file
+// Function for getting the public keys which are given in the config file
 // and the private key which is generated on the fly and not stored.
-// Returns the generated private key and a list with the public key
-// in order to encrypt the file.
-func getKeys(path string) ([32]byte, [][32]byte, error) {
+// Returns the generated private key and the list of public keys
+// in order to encrypt the file to all of them.
+func getKeys(paths []string) ([32]byte, [][32]byte, error) {
+	if len(paths) == 0 {
+		return [32]byte{}, nil, fmt.Errorf("no crypt4gh public key configured")
+	}
+
 	privateKeyData, err := generatePrivateKey()
 	if err != nil {
 		log.Debug("Could not generate private key")
@@ -33,24 +38,30 @@ func getKeys(path string) ([32]byte, [][32]byte, error) {
 		return [32]byte{}, nil, err
 	}
 
+	var publicKeyFileList [][32]byte
+	for _, path := range paths {
+		publicKeyData, err := readPublicKey(path)
+		if err != nil {
+			return [32]byte{}, nil, fmt.Errorf("could not load public key %s: %s", path, err)
+		}
+		publicKeyFileList = append(publicKeyFileList, publicKeyData)
+	}
+
+	return *privateKeyData, publicKeyFileList, nil
+}
+
+// readPublicKey reads a crypt4gh public key from a file
+func readPublicKey(path string) ([32]byte, error) {
 	path = filepath.Clean(path) // gosec G304
 	publicKey, err := os.Open(path)
 	if err != nil {
 		log.Debug("Could not open public key")
 
-		return [32]byte{}, nil, err
-	}
-	publicKeyData, err := keys.ReadPublicKey(publicKey)
-	if err != nil {
-		log.Debug("Could not load public key")
-
-		return [32]byte{}, nil, err
+		return [32]byte{}, err
 	}
+	defer publicKey.Close()
 
-	var publicKeyFileList [][32]byte
-	publicKeyFileList = append(publicKeyFileList, publicKeyData)
-
-	return *privateKeyData, publicKeyFileList, nil
+	return keys.ReadPublicKey(publicKey)
 }
 
 // Function for retrieving the private key (for decrypting) which is given in the config file
@@ -91,3 +102,46 @@ func newEncryptor(pubKeyList [][32]byte, privateKey [32]byte, w io.Writer) (*str
 
 	return crypt4GHWriter, nil
 }
+
+// backupReader is the decrypted and decompressed content of a backup object
+type backupReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the decompressor, the decryptor and the object, in that order
+func (br *backupReader) Close() error {
+	var err error
+	for _, c := range br.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// newBackupReader opens a backup object and returns its plaintext
+func newBackupReader(sb *s3Backend, privateKey [32]byte, name string) (io.ReadCloser, error) {
+	fr, err := sb.NewFileReader(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newDecryptor(privateKey, fr)
+	if err != nil {
+		_ = fr.Close()
+
+		return nil, fmt.Errorf("could not initialise decryptor: %s", err)
+	}
+
+	d, err := newDecompressor(r)
+	if err != nil {
+		_ = r.Close()
+		_ = fr.Close()
+
+		return nil, fmt.Errorf("could not initialise decompressor: %s", err)
+	}
+
+	return &backupReader{Reader: d, closers: []io.Closer{d, r, fr}}, nil
+}
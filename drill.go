@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// drillPrefix starts the names of the scratch targets of a restore drill, the
+// reports are stored under a prefix of the same name
+const drillPrefix = "drill"
+
+// pgCountQuery counts the tables of a database and the rows in all of them
+const pgCountQuery = `SELECT count(*), coalesce(sum((xpath('/row/c/text()',
+	query_to_xml(format('SELECT count(*) AS c FROM %I.%I', table_schema, table_name), false, true, '')))[1]::text::bigint), 0)
+	FROM information_schema.tables
+	WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')`
+
+var (
+	// mongoRestoredDocuments matches the summary mongorestore ends with
+	mongoRestoredDocuments = regexp.MustCompile(`(\d+) document\(s\) restored successfully\. (\d+) document\(s\) failed to restore`)
+	// mongoRestoredCollection matches the line logged for every collection
+	mongoRestoredCollection = regexp.MustCompile(`finished restoring \S+ \(\d+ documents?, \d+ failures?\)`)
+)
+
+// drillReport is the proof that the latest backups could be restored, it is
+// stored in the bucket under <PathPrefix>/drill/
+type drillReport struct {
+	Started   time.Time          `json:"started"`
+	Finished  time.Time          `json:"finished"`
+	Passed    bool               `json:"passed"`
+	Results   []*drillResult     `json:"results"`
+	Signature *manifestSignature `json:"signature,omitempty"`
+}
+
+// drillResult is the outcome of restoring one backup into a scratch target
+type drillResult struct {
+	Kind      string           `json:"kind"`
+	Backup    string           `json:"backup"`
+	Target    string           `json:"target"`
+	Counts    map[string]int64 `json:"counts,omitempty"`
+	Duration  string           `json:"duration"`
+	CleanedUp bool             `json:"cleaned_up"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// fail records the error that ended a drill
+func (r *drillResult) fail(err error) {
+	log.Errorf("Restore drill of %s failed: %v", r.Kind, err)
+	r.Error = err.Error()
+}
+
+// restoreDrill restores the latest backup of every configured database into
+// a scratch target, counts what was restored and removes the target again.
+// The outcome is written to a report in the bucket, and an error is
+// returned when any of the restores failed or a target was not removed.
+func restoreDrill(sb *s3Backend, conf *Config) error {
+	report := &drillReport{Started: time.Now().UTC()}
+	scratch := drillPrefix + "_" + report.Started.Format(backupTimeFormat)
+
+	if conf.db.host != "" {
+		report.Results = append(report.Results, drillPostgres(sb, conf.db, conf.privateKeys, scratch))
+	}
+	if conf.mongo.host != "" {
+		report.Results = append(report.Results, drillMongo(sb, conf.mongo, conf.privateKeys, scratch))
+	}
+	if conf.elastic.host != "" {
+		report.Results = append(report.Results, drillElastic(sb, conf.elastic, conf.privateKeys, scratch)...)
+	}
+	if len(report.Results) == 0 {
+		return fmt.Errorf("restore_drill needs at least one of db, mongo or elastic to be configured")
+	}
+
+	report.Finished = time.Now().UTC()
+	report.Passed = true
+	for _, r := range report.Results {
+		if r.Error != "" {
+			report.Passed = false
+		}
+		if !r.CleanedUp {
+			log.Errorf("Scratch target %s of the %s drill was not removed", r.Target, r.Kind)
+			report.Passed = false
+		}
+	}
+
+	key, err := sb.writeDrillReport(report, conf.signingKeyPath)
+	if err != nil {
+		return err
+	}
+	if !report.Passed {
+		return fmt.Errorf("restore drill failed, see %s", key)
+	}
+	log.Infof("Restore drill passed, report written to %s", key)
+
+	return nil
+}
+
+// drillPostgres restores the latest dump into a new database and counts its
+// tables and rows
+func drillPostgres(sb *s3Backend, db DBConf, privateKeys keySource, scratch string) *drillResult {
+	started := time.Now()
+	result := &drillResult{Kind: "pg_dump", Target: scratch}
+	defer func() { result.Duration = time.Since(started).Round(time.Second).String() }()
+
+	name, err := resolveBackupName(sb, "latest", "", ".sqldump", db.database)
+	if err != nil {
+		result.fail(err)
+		result.CleanedUp = true
+
+		return result
+	}
+	result.Backup = name
+
+	if _, err := db.psql(fmt.Sprintf(`CREATE DATABASE "%s"`, scratch)); err != nil {
+		result.fail(fmt.Errorf("could not create scratch database: %s", err))
+		result.CleanedUp = true
+
+		return result
+	}
+	defer func() {
+		if _, err := db.psql(fmt.Sprintf(`DROP DATABASE "%s"`, scratch)); err != nil {
+			log.Errorf("Could not drop scratch database %s: %v", scratch, err)
+
+			return
+		}
+		result.CleanedUp = true
+	}()
+
+	target := db
+	target.database = scratch
+	if err := target.restore(*sb, privateKeys, name); err != nil {
+		result.fail(err)
+
+		return result
+	}
+
+	out, err := target.psql(pgCountQuery)
+	if err != nil {
+		result.fail(fmt.Errorf("could not count rows: %s", err))
+
+		return result
+	}
+	counts := strings.Split(out, "|")
+	if len(counts) != 2 {
+		result.fail(fmt.Errorf("unexpected output of the row count: %q", out))
+
+		return result
+	}
+	tables, _ := strconv.ParseInt(counts[0], 10, 64)
+	rows, _ := strconv.ParseInt(counts[1], 10, 64)
+	result.Counts = map[string]int64{"tables": tables, "rows": rows}
+	log.Infof("Restored %s into %s: %d tables, %d rows", name, scratch, tables, rows)
+
+	return result
+}
+
+// drillMongo restores the latest archive into a new database and counts its
+// collections and documents from the output of mongorestore
+func drillMongo(sb *s3Backend, mongo mongoConfig, privateKeys keySource, scratch string) *drillResult {
+	started := time.Now()
+	result := &drillResult{Kind: "mongo_dump", Target: scratch}
+	defer func() { result.Duration = time.Since(started).Round(time.Second).String() }()
+
+	name, err := resolveBackupName(sb, "latest", "", ".archive", mongo.database)
+	if err != nil {
+		result.fail(err)
+		result.CleanedUp = true
+
+		return result
+	}
+	result.Backup = name
+
+	entry, _ := parseBackupName(name, time.Time{})
+	target := mongo
+	target.database = entry.Source
+	target.restoreDatabase = scratch
+	defer func() {
+		if err := dropMongoDatabase(target); err != nil {
+			log.Errorf("Could not drop scratch database %s: %v", scratch, err)
+
+			return
+		}
+		result.CleanedUp = true
+	}()
+
+	out, err := target.restoreArchive(*sb, privateKeys, name)
+	if err != nil {
+		result.fail(err)
+
+		return result
+	}
+
+	m := mongoRestoredDocuments.FindStringSubmatch(out)
+	if m == nil {
+		result.fail(fmt.Errorf("could not find the document count in the output of mongorestore"))
+
+		return result
+	}
+	documents, _ := strconv.ParseInt(m[1], 10, 64)
+	failed, _ := strconv.ParseInt(m[2], 10, 64)
+	collections := int64(len(mongoRestoredCollection.FindAllString(out, -1)))
+	result.Counts = map[string]int64{"collections": collections, "documents": documents, "failed": failed}
+	log.Infof("Restored %s into %s: %d collections, %d documents, %d failed", name, scratch, collections, documents, failed)
+	if failed > 0 {
+		result.fail(fmt.Errorf("%d documents failed to restore", failed))
+	}
+
+	return result
+}
+
+// dropMongoDatabase drops the restoreDatabase with mongosh, which is not part
+// of the database tools and has to be installed separately
+func dropMongoDatabase(mongo mongoConfig) error {
+	if _, err := exec.LookPath("mongosh"); err != nil {
+		return fmt.Errorf("mongosh is not installed, drop the database %s by hand", mongo.restoreDatabase)
+	}
+
+	cmd := exec.Command("sh", "-c", buildDropCommand(mongo))
+	var errMsg bytes.Buffer
+	cmd.Stderr = &errMsg
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mongosh failed: %s: %s", err, errMsg.String())
+	}
+
+	return nil
+}
+
+// drillElastic restores the latest full backup of every index into a new
+// index each and counts their documents. The restore itself already checks
+// the count against the backup.
+func drillElastic(sb *s3Backend, config elasticConfig, privateKeys keySource, scratch string) []*drillResult {
+	failed := func(err error) []*drillResult {
+		result := &drillResult{Kind: "es_backup", Target: scratch, Duration: "0s", CleanedUp: true}
+		result.fail(err)
+
+		return []*drillResult{result}
+	}
+
+	config.restoreSuffix = ""
+	// a drill must never move an alias to its scratch index
+	config.restoreAlias = ""
+	es, err := newElasticClient(config)
+	if err != nil {
+		return failed(err)
+	}
+
+	backups, err := latestElasticBackups(sb, config.filePrefix)
+	if err != nil {
+		return failed(err)
+	}
+	if len(backups) == 0 {
+		return failed(fmt.Errorf("no .bup backup found"))
+	}
+
+	results := make([]*drillResult, 0, len(backups))
+	for _, b := range backups {
+		index := strings.ToLower(path.Base(strings.TrimPrefix(b.Source, config.filePrefix)))
+		results = append(results, drillElasticIndex(sb, es, privateKeys, b.Name, scratch+"_"+index))
+	}
+
+	return results
+}
+
+// latestElasticBackups returns the newest full backup of every index backed
+// up with filePrefix, partial backups are left out
+func latestElasticBackups(sb *s3Backend, filePrefix string) ([]backupEntry, error) {
+	backups, err := listBackups(sb)
+	if err != nil {
+		return nil, fmt.Errorf("could not list backups: %s", err)
+	}
+
+	var latest []backupEntry
+	seen := make(map[string]bool)
+	// listBackups returns the newest backup of each source first
+	for _, b := range backups {
+		partial := strings.HasSuffix(b.Source, strings.TrimSuffix(partialBackupSuffix, "-"))
+		if b.Kind != "bup" || partial || seen[b.Source] || !strings.HasPrefix(b.Source, filePrefix) {
+			continue
+		}
+		seen[b.Source] = true
+		latest = append(latest, b)
+	}
+
+	return latest, nil
+}
+
+// drillElasticIndex restores a backup into the scratch index and counts its
+// documents
+func drillElasticIndex(sb *s3Backend, es *esClient, privateKeys keySource, name, scratch string) *drillResult {
+	started := time.Now()
+	result := &drillResult{Kind: "es_backup", Backup: name, Target: scratch}
+	defer func() { result.Duration = time.Since(started).Round(time.Second).String() }()
+
+	es.conf.restoreIndex = scratch
+	defer func() {
+		if err := es.deleteIndex(scratch); err != nil {
+			log.Errorf("Could not delete scratch index %s: %v", scratch, err)
+
+			return
+		}
+		result.CleanedUp = true
+	}()
+
+	if err := es.restoreDocuments(sb, privateKeys, name); err != nil {
+		result.fail(err)
+
+		return result
+	}
+
+	documents, err := es.countDocuments(scratch)
+	if err != nil {
+		result.fail(err)
+
+		return result
+	}
+	result.Counts = map[string]int64{"documents": documents}
+	log.Infof("Restored %s into %s: %d documents", name, scratch, documents)
+
+	return result
+}
+
+// deleteIndex removes an index, an index that does not exist is not an error
+func (es esClient) deleteIndex(index string) error {
+	res, err := es.client.Indices.Delete([]string{index})
+	if err != nil {
+		return fmt.Errorf("could not delete index: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("could not delete index %s: %s", index, readResponse(res.Body))
+	}
+
+	return nil
+}
+
+// writeDrillReport signs the report, if a signing key is configured, and
+// stores it in the bucket. The key of the report is returned.
+func (sb *s3Backend) writeDrillReport(report *drillReport, signingKeyPath string) (string, error) {
+	if signingKeyPath != "" {
+		key, err := readSigningKey(signingKeyPath)
+		if err != nil {
+			return "", fmt.Errorf("could not read manifest signing key: %s", err)
+		}
+		payload, err := json.Marshal(report)
+		if err != nil {
+			return "", err
+		}
+		report.Signature = signPayload(key, payload)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	key := path.Join(sb.PathPrefix, drillPrefix, report.Started.Format(backupTimeFormat)+"-restore-drill.json")
+	_, err = sb.Uploader.Upload(&s3manager.UploadInput{
+		Body:        bytes.NewReader(data),
+		Bucket:      aws.String(sb.Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not upload drill report: %s", err)
+	}
+
+	return key, nil
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -33,6 +37,38 @@ type elasticConfig struct {
 	caCert     string
 	batchSize  int
 	filePrefix string
+	// pagination selects how indices are read, "scroll" or "pit"
+	pagination string
+	// keepAlive is how long a scroll or point in time is kept between batches
+	keepAlive time.Duration
+	// slices splits the scroll of an index into this many slices
+	slices int
+	// parts exports each index in this many slices in parallel, each to its own object
+	parts int
+	// bulkWorkers and bulkFlushBytes configure the bulk indexer used on restore
+	bulkWorkers    int
+	bulkFlushBytes int
+	// restoreIndex and restoreSuffix give the name of the index a backup is
+	// restored into, by default the name of the index that was backed up
+	restoreIndex  string
+	restoreSuffix string
+	// restoreAlias is moved to the restored index once the restore is done
+	restoreAlias string
+	// query limits a backup to the documents that match it
+	query string
+	// timeField, since and until limit a backup to the documents with a
+	// timeField between now-since and now-until
+	timeField string
+	since     time.Duration
+	until     time.Duration
+	// snapshotRepository, snapshotClient and snapshotBasePath configure the
+	// S3 repository used for native snapshots
+	snapshotRepository string
+	snapshotClient     string
+	snapshotBasePath   string
+	// restoreMode is the bulk action used when restoring documents, "index"
+	// overwrites documents with the same _id and "create" leaves them as is
+	restoreMode string
 }
 
 type esClient struct {
@@ -43,6 +79,10 @@ type esClient struct {
 func newElasticClient(config elasticConfig) (*esClient, error) {
 	retryBackoff := backoff.NewExponentialBackOff()
 
+	if config.keepAlive == 0 {
+		config.keepAlive = time.Minute
+	}
+
 	tr := transportConfigES(config)
 	URI := esURI(config)
 	c, err := elasticsearch.NewClient(elasticsearch.Config{
@@ -108,32 +148,32 @@ func readResponse(r io.Reader) string {
 	return b.String()
 }
 
-func (es esClient) countDocuments(indexName string) error {
-	log.Infoln("Couting documents to fetch...")
-	log.Infoln(strings.Repeat("-", 80))
+// countDocuments returns the number of documents in an index, an index
+// that does not exist holds no documents
+func (es esClient) countDocuments(indexName string) (int64, error) {
 	cr, err := es.client.Count(es.client.Count.WithIndex(indexName))
-
 	if err != nil {
-		log.Error(err)
-
-		return err
+		return 0, err
 	}
 
 	json := readResponse(cr.Body)
 	err = cr.Body.Close()
 	if err != nil {
-		log.Error(err)
-
-		return fmt.Errorf("error while closing count response: %v", err)
+		return 0, fmt.Errorf("error while closing count response: %v", err)
+	}
+	if cr.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if cr.IsError() {
+		return 0, fmt.Errorf("could not count documents in %s: %s", indexName, json)
 	}
 
-	count := int(gjson.Get(json, "count").Int())
-
-	log.Infof("Found %v documents", count)
-
-	return nil
+	return gjson.Get(json, "count").Int(), nil
 }
 
+// errNoIndices is returned by findIndices when no index matches the glob
+var errNoIndices = errors.New("no indices found")
+
 func findIndices(es esClient, indexGlob string) ([]string, error) {
 	log.Infoln("Finding indices to fetch...")
 	log.Infoln(strings.Repeat("-", 80))
@@ -148,6 +188,12 @@ func findIndices(es esClient, indexGlob string) ([]string, error) {
 	defer cr.Body.Close()
 
 	json := readResponse(cr.Body)
+	if cr.StatusCode == http.StatusNotFound {
+		return nil, errNoIndices
+	}
+	if cr.IsError() {
+		return nil, fmt.Errorf("could not list indices: %s", json)
+	}
 	result := gjson.Get(json, "#.index")
 
 	var indices []string
@@ -155,19 +201,266 @@ func findIndices(es esClient, indexGlob string) ([]string, error) {
 		indices = append(indices, index.String())
 	}
 	if len(indices) == 0 {
-		return nil, fmt.Errorf("no indices found")
+		return nil, errNoIndices
 	}
 	log.Debugf("Found indices: %v", indices)
 
 	return indices, err
 }
 
-func (es esClient) backupDocuments(sb *s3Backend, publicKeyPath, indexGlob string) error {
+// findDataStreams returns the data streams that match the glob, together
+// with their backing indices. Clusters without data streams have none.
+func findDataStreams(es esClient, glob string) (map[string][]string, error) {
+	res, err := es.client.Indices.GetDataStream(es.client.Indices.GetDataStream.WithName(glob))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body := readResponse(res.Body)
+	if res.IsError() {
+		log.Debugf("No data streams found: %s", body)
+
+		return nil, nil
+	}
+
+	streams := make(map[string][]string)
+	for _, ds := range gjson.Get(body, "data_streams").Array() {
+		var indices []string
+		for _, index := range ds.Get("indices.#.index_name").Array() {
+			indices = append(indices, index.String())
+		}
+		streams[ds.Get("name").String()] = indices
+	}
+	log.Debugf("Found data streams: %v", streams)
+
+	return streams, nil
+}
+
+// clusterVersion returns the Elasticsearch version reported by the cluster
+func (es esClient) clusterVersion() string {
+	res, err := es.client.Info()
+	if err != nil {
+		log.Debugf("Could not get cluster info: %v", err)
+
+		return "unknown"
+	}
+	defer res.Body.Close()
+
+	return gjson.Get(readResponse(res.Body), "version.number").String()
+}
+
+// indexSettingsInternal are index settings set by Elasticsearch itself,
+// they can not be given when an index is created.
+var indexSettingsInternal = []string{
+	"creation_date",
+	"provided_name",
+	"uuid",
+	"version",
+	"resize",
+	"routing.allocation.initial_recovery",
+}
+
+// indexMetadata holds what is needed to recreate an index on restore
+type indexMetadata struct {
+	Index    string                     `json:"index"`
+	Mappings json.RawMessage            `json:"mappings,omitempty"`
+	Settings map[string]json.RawMessage `json:"settings,omitempty"`
+	Aliases  json.RawMessage            `json:"aliases,omitempty"`
+}
+
+// backupHeader is the first line of a backup, it is told apart from the
+// batches of hits that follow since it is an object and not an array.
+type backupHeader struct {
+	Metadata *indexMetadata `json:"metadata"`
+	// Parts lists the objects holding the documents of a backup that was
+	// exported in parallel slices, the backup itself then holds no documents
+	Parts []string `json:"parts,omitempty"`
+	// Query is set for partial backups, only the documents matching it were
+	// backed up
+	Query json.RawMessage `json:"query,omitempty"`
+	// DataStream is set when the backup holds the documents of a data
+	// stream, Metadata then only holds the name of the stream
+	DataStream bool `json:"data_stream,omitempty"`
+}
+
+// backupQuery returns the query selecting the documents to back up, or nil
+// when whole indices are backed up. The time range is resolved against now
+// so that the recorded query shows exactly which documents the backup holds.
+func (es esClient) backupQuery(now time.Time) (json.RawMessage, error) {
+	var filters []interface{}
+
+	if es.conf.query != "" {
+		if !json.Valid([]byte(es.conf.query)) {
+			return nil, fmt.Errorf("elastic query is not valid JSON")
+		}
+		filters = append(filters, json.RawMessage(es.conf.query))
+	}
+
+	if es.conf.timeField != "" {
+		if es.conf.since <= 0 {
+			return nil, fmt.Errorf("elastic timeField is set but since is not")
+		}
+		filters = append(filters, map[string]map[string]map[string]string{
+			"range": {
+				es.conf.timeField: {
+					"gte": now.Add(-es.conf.since).UTC().Format(time.RFC3339),
+					"lt":  now.Add(-es.conf.until).UTC().Format(time.RFC3339),
+				},
+			},
+		})
+	}
+
+	switch len(filters) {
+	case 0:
+		return nil, nil
+	case 1:
+		if q, ok := filters[0].(json.RawMessage); ok {
+			return q, nil
+		}
+	}
+
+	return json.Marshal(map[string]map[string]interface{}{"bool": {"filter": filters}})
+}
+
+// getIndexMetadata returns the mappings, settings and aliases of an index
+func (es esClient) getIndexMetadata(index string) (*indexMetadata, error) {
+	res, err := es.client.Indices.Get([]string{index}, es.client.Indices.Get.WithFlatSettings(true))
+	if err != nil {
+		return nil, fmt.Errorf("could not get index metadata: %s", err)
+	}
+	defer res.Body.Close()
+
+	body := readResponse(res.Body)
+	if res.IsError() {
+		return nil, fmt.Errorf("could not get index metadata: %s", body)
+	}
+
+	info := gjson.Get(body, gjson.Escape(index))
+	metadata := &indexMetadata{Index: index, Settings: make(map[string]json.RawMessage)}
+	if mappings := info.Get("mappings"); mappings.Exists() {
+		metadata.Mappings = json.RawMessage(mappings.Raw)
+	}
+	if aliases := info.Get("aliases"); aliases.Exists() {
+		metadata.Aliases = json.RawMessage(aliases.Raw)
+	}
+
+	info.Get("settings").ForEach(func(key, value gjson.Result) bool {
+		for _, internal := range indexSettingsInternal {
+			if strings.HasPrefix(key.String(), "index."+internal) {
+				return true
+			}
+		}
+		metadata.Settings[key.String()] = json.RawMessage(value.Raw)
+
+		return true
+	})
+
+	return metadata, nil
+}
+
+// targetIndex returns the name of the index that a backup of the original
+// index is restored into.
+func (es esClient) targetIndex(original string) string {
+	target := original
+	if es.conf.restoreIndex != "" {
+		target = es.conf.restoreIndex
+	}
+
+	return target + es.conf.restoreSuffix
+}
+
+// switchAlias points an alias at the index, removing it from every other
+// index in the same request so that the switch is atomic.
+func (es esClient) switchAlias(alias, index string) error {
+	actions := []map[string]map[string]string{}
+
+	res, err := es.client.Indices.GetAlias(es.client.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		return fmt.Errorf("could not get alias %s: %s", alias, err)
+	}
+	body := readResponse(res.Body)
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		gjson.Parse(body).ForEach(func(current, _ gjson.Result) bool {
+			if current.String() != index {
+				actions = append(actions, map[string]map[string]string{"remove": {"index": current.String(), "alias": alias}})
+			}
+
+			return true
+		})
+	}
+	actions = append(actions, map[string]map[string]string{"add": {"index": index, "alias": alias}})
+
+	data, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+
+	res, err = es.client.Indices.UpdateAliases(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("could not update alias %s: %s", alias, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not update alias %s: %s", alias, readResponse(res.Body))
+	}
+	log.Infof("Alias %s now points to %s", alias, index)
+
+	return nil
+}
+
+// createIndex creates an index from the metadata of a backup, an index that
+// already exists is left as it is. The aliases of the backup are only added
+// when the index is restored under its original name, so that a restore next
+// to the live index does not take over its aliases.
+func (es esClient) createIndex(name string, metadata *indexMetadata) error {
+	res, err := es.client.Indices.Exists([]string{name})
+	if err != nil {
+		return fmt.Errorf("could not check if index exists: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		log.Infof("Index %s already exists, keeping its mappings and settings", name)
+
+		return nil
+	}
+
+	index := make(map[string]interface{})
+	if len(metadata.Mappings) > 0 {
+		index["mappings"] = metadata.Mappings
+	}
+	if len(metadata.Settings) > 0 {
+		index["settings"] = metadata.Settings
+	}
+	if len(metadata.Aliases) > 0 {
+		if name == metadata.Index {
+			index["aliases"] = metadata.Aliases
+		} else {
+			log.Infof("Not adding the aliases of %s to %s", metadata.Index, name)
+		}
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	res, err = es.client.Indices.Create(name, es.client.Indices.Create.WithBody(bytes.NewReader(body)))
+	if err != nil {
+		return fmt.Errorf("could not create index: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not create index: %s", readResponse(res.Body))
+	}
+	log.Infof("Created index %s from backup metadata", name)
+
+	return nil
+}
+
+func (es esClient) backupDocuments(sb *s3Backend, publicKeyPaths []string, signingKeyPath, indexGlob string) error {
 	log.Infof("Backing up indexes that match glob: %s", indexGlob)
-	var (
-		batchNum int
-		scrollID string
-	)
 
 	batchsize := 50
 	filePrefix := ""
@@ -180,227 +473,554 @@ func (es esClient) backupDocuments(sb *s3Backend, publicKeyPath, indexGlob strin
 		filePrefix = es.conf.filePrefix
 	}
 
+	streams, err := findDataStreams(es, indexGlob)
+	if err != nil {
+		return fmt.Errorf("could not get data streams: %s", err)
+	}
+
+	// the backing indices of data streams are backed up through their stream
+	backing := make(map[string]bool)
+	for _, indices := range streams {
+		for _, index := range indices {
+			backing[index] = true
+		}
+	}
+
+	// a glob may match only data streams, any other error ends the backup
 	targetIndices, err := findIndices(es, indexGlob)
+	if err != nil && !(errors.Is(err, errNoIndices) && len(streams) > 0) {
+		return err
+	}
+
+	privateKey, publicKeyList, err := getKeys(publicKeyPaths)
+	if err != nil {
+		return fmt.Errorf("could not retrieve public key or generate private key: %s", err)
+	}
+
+	log.Debug("Public key retrieved and private key successfully created")
+
+	now := time.Now()
+	query, err := es.backupQuery(now)
 	if err != nil {
 		return err
 	}
+	suffix := ".bup"
+	if query != nil {
+		log.Infof("Only backing up documents matching: %s", query)
+		// partial backups must not replace the full backup of an index
+		suffix = partialBackupSuffix + now.Format(backupTimeFormat) + ".bup"
+	}
+
+	bw := backupWriter{
+		sb:             sb,
+		publicKeyList:  publicKeyList,
+		privateKey:     privateKey,
+		signingKeyPath: signingKeyPath,
+		esVersion:      es.clusterVersion(),
+	}
 
 	for _, index := range targetIndices {
-		wg := sync.WaitGroup{}
-		wr, err := sb.NewFileWriter(filePrefix+index+".bup", &wg)
+		if backing[index] {
+			log.Debugf("Skipping %s, it is backed up with its data stream", index)
 
-		if err != nil {
-			log.Fatalf("Could not open backup file for writing: %v", err)
+			continue
 		}
 
-		log.Debug("Backup file ready for writing")
-
-		privateKey, publicKeyList, err := getKeys(publicKeyPath)
+		metadata, err := es.getIndexMetadata(index)
 		if err != nil {
-			return fmt.Errorf("could not retrieve public key or generate private key: %s", err)
+			return err
+		}
 
+		header := backupHeader{Metadata: metadata, Query: query}
+		if err := es.backupIndex(bw, filePrefix+index+suffix, index, header, batchsize); err != nil {
+			return err
 		}
+	}
+
+	names := make([]string, 0, len(streams))
+	for stream := range streams {
+		names = append(names, stream)
+	}
+	sort.Strings(names)
+	for _, stream := range names {
+		header := backupHeader{Metadata: &indexMetadata{Index: stream}, Query: query, DataStream: true}
+		if err := es.backupIndex(bw, filePrefix+stream+suffix, stream, header, batchsize); err != nil {
+			return err
+		}
+	}
 
-		log.Debug("Public key retrieved and private key successfully created")
+	return nil
+}
 
-		e, err := newEncryptor(publicKeyList, privateKey, wr)
+// backupIndex writes the header and the documents of an index, or a data
+// stream, to the backup object name
+func (es esClient) backupIndex(bw backupWriter, name, index string, header backupHeader, batchsize int) error {
+	_, err := es.client.Indices.Refresh(es.client.Indices.Refresh.WithIndex(index))
+	if err != nil {
+		return fmt.Errorf("could not refresh indexes: %s", err)
+	}
 
+	if es.conf.parts > 1 {
+		header.Parts, err = es.backupParts(bw, name, index, batchsize, header.Query)
 		if err != nil {
-			return fmt.Errorf("could not initialize encryptor: %s", err)
+			return err
 		}
+	}
 
-		c, err := newCompressor(e)
-
+	return bw.write(name, index, func(w io.Writer) error {
+		line, err := json.Marshal(header)
 		if err != nil {
-			return fmt.Errorf("could not initialize encryptor: %s", err)
+			return err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("could not encrypt/write: %s", err)
 		}
 
-		_, err = es.client.Indices.Refresh(es.client.Indices.Refresh.WithIndex(index))
-
-		if err != nil {
-			return fmt.Errorf("could not refresh indexes: %s", err)
+		if len(header.Parts) > 0 {
+			return nil
 		}
 
-		res, err := es.client.Search(
-			es.client.Search.WithIndex(index),
-			es.client.Search.WithSize(batchsize),
-			es.client.Search.WithSort("_doc"),
-			es.client.Search.WithScroll(time.Second*60),
-		)
+		return writeHits(es.newPager(index, batchsize, header.Query), w)
+	})
+}
+
+// backupParts exports the slices of an index in parallel, each slice is
+// written to its own part object. The names of the parts are returned in
+// slice order.
+func (es esClient) backupParts(bw backupWriter, name, index string, batchsize int, query json.RawMessage) ([]string, error) {
+	parts := make([]string, es.conf.parts)
+	errs := make([]error, es.conf.parts)
+	wg := sync.WaitGroup{}
+
+	for slice := range parts {
+		parts[slice] = fmt.Sprintf("%s.part-%03d", name, slice)
+		wg.Add(1)
+		go func(slice int) {
+			defer wg.Done()
+			pager := &scrollPager{es: es, index: index, size: batchsize, query: query, slice: slice, maxSlices: es.conf.parts}
+			errs[slice] = bw.write(parts[slice], index, func(w io.Writer) error {
+				return writeHits(pager, w)
+			})
+		}(slice)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("could not back up all parts of %s: %w", index, err)
+	}
+	log.Infof("Backed up %s in %d parts", index, len(parts))
+
+	return parts, nil
+}
+
+// writeHits writes the batches returned by the pager, one line per batch,
+// and releases the search context of the pager when done.
+func writeHits(pager hitPager, w io.Writer) error {
+	defer pager.close()
 
+	for batchNum := 0; ; batchNum++ {
+		hits, err := pager.next()
 		if err != nil {
 			return err
 		}
+		log.Trace(hits)
 
-		json := readResponse(res.Body)
-		err = res.Body.Close()
-		if err != nil {
-			return fmt.Errorf("error while closing response: %v", err)
+		if len(hits.Array()) < 1 {
+			log.Traceln("Finished scrolling")
+
+			return nil
 		}
 
-		hits := gjson.Get(json, "hits.hits")
-		_, err = c.Write([]byte(hits.Raw + "\n"))
+		_, err = w.Write([]byte(hits.Raw + "\n"))
 		if err != nil {
 			return fmt.Errorf("could not encrypt/write: %s", err)
 		}
-
 		log.Debug("Batch   ", batchNum)
-		log.Trace("ScrollID", scrollID)
 		log.Trace("IDs     ", gjson.Get(hits.Raw, "#._id"))
 		log.Trace(strings.Repeat("-", 80))
+	}
+}
 
-		scrollID = gjson.Get(json, "_scroll_id").String()
+// backupWriter creates the encrypted and compressed backup objects, and
+// their manifests, of an Elasticsearch backup
+type backupWriter struct {
+	sb             *s3Backend
+	publicKeyList  [][32]byte
+	privateKey     [32]byte
+	signingKeyPath string
+	esVersion      string
+}
 
-		for {
-			batchNum++
+// write stores the plaintext produced by fill as the backup object name
+func (bw backupWriter) write(name, index string, fill func(w io.Writer) error) error {
+	manifest := newBackupManifest(name, "elasticsearch", index)
+	manifest.ToolVersions["elasticsearch"] = bw.esVersion
 
-			res, err := es.client.Scroll(es.client.Scroll.WithScrollID(scrollID), es.client.Scroll.WithScroll(time.Minute))
-			if err != nil {
-				return err
-			}
-			if res.IsError() {
-				return fmt.Errorf("error response: %s", err)
-			}
+	wg := sync.WaitGroup{}
+	wr, err := bw.sb.NewFileWriter(name, &wg)
+	if err != nil {
+		return fmt.Errorf("could not open backup file for writing: %v", err)
+	}
 
-			json = readResponse(res.Body)
-			err = res.Body.Close()
-			if err != nil {
-				return fmt.Errorf("error while closing response: %v", err)
-			}
+	log.Debugf("Backup file %s ready for writing", name)
 
-			scrollID = gjson.Get(json, "_scroll_id").String()
+	e, err := newEncryptor(bw.publicKeyList, bw.privateKey, wr)
+	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
 
-			hits := gjson.Get(json, "hits.hits")
-			log.Trace(hits)
+		return fmt.Errorf("could not initialize encryptor: %s", err)
+	}
 
-			if len(hits.Array()) < 1 {
-				log.Traceln("Finished scrolling")
+	compressed := newMeasuredWriter(e, false)
+	cw, err := newCompressor(compressed)
+	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
 
-				break
-			}
+		return fmt.Errorf("could not initialize compressor: %s", err)
+	}
+	c := newMeasuredWriter(cw, true)
 
-			_, err = c.Write([]byte(hits.Raw + "\n"))
-			if err != nil {
-				return fmt.Errorf("could not encrypt/write: %s", err)
-			}
-			log.Debug("Batch   ", batchNum)
-			log.Trace("ScrollID", scrollID)
-			log.Trace("IDs     ", gjson.Get(hits.Raw, "#._id"))
-			log.Trace(strings.Repeat("-", 80))
-		}
-		if err := c.Close(); err != nil {
-			log.Errorf("could not close compressor: %v", err)
-		}
+	if err := fill(c); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
 
-		if err := e.Close(); err != nil {
-			log.Errorf("could not close encryptor: %v", err)
-		}
+		return err
+	}
 
-		if err := wr.Close(); err != nil {
-			log.Errorf("could not close destination file: %v", err)
-		}
+	if err := cw.Close(); err != nil {
+		abortWriter(wr, err)
 		wg.Wait()
+
+		return fmt.Errorf("could not close compressor: %s", err)
+	}
+
+	if err := e.Close(); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("could not close encryptor: %s", err)
+	}
+
+	if err := wr.Close(); err != nil {
+		wg.Wait()
+
+		return fmt.Errorf("could not upload %s: %s", name, err)
+	}
+	wg.Wait()
+
+	// the manifest is only written for a backup that was stored completely
+	manifest.Recipients = keyFingerprints(bw.publicKeyList)
+	manifest.finish(c, compressed)
+
+	return bw.sb.writeManifest(manifest, bw.signingKeyPath)
+}
+
+// restoreRun holds the state shared by the parts of a restore
+type restoreRun struct {
+	es         *esClient
+	bi         esutil.BulkIndexer
+	index      string
+	action     string
+	read       uint64
+	successful uint64
+	existing   uint64
+
+	// before is the number of documents in the index before the first
+	// document of the backup was added
+	before    int64
+	countOnce sync.Once
+	countErr  error
+
+	mu       sync.Mutex
+	failures map[string]uint64
+}
+
+// countBefore counts the documents in the target index once, before the
+// first document is added to it
+func (run *restoreRun) countBefore() error {
+	run.countOnce.Do(func() {
+		run.before, run.countErr = run.es.countDocuments(run.index)
+	})
+
+	return run.countErr
+}
+
+// addFailure records a document that could not be indexed
+func (run *restoreRun) addFailure(reason string) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	run.failures[reason]++
+}
+
+// restoreReport summarizes a finished restore
+type restoreReport struct {
+	index    string
+	action   string
+	read     uint64
+	indexed  uint64
+	existing uint64
+	failures map[string]uint64
+	before   int64
+	final    int64
+}
+
+func (r restoreReport) log() {
+	log.Infof("Restore report for %s", r.index)
+	log.Infof("  documents read from backup: %d", r.read)
+	log.Infof("  documents indexed:          %d", r.indexed)
+	if r.action == "create" {
+		log.Infof("  documents already present:  %d", r.existing)
+	}
+	reasons := make([]string, 0, len(r.failures))
+	for reason := range r.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		log.Infof("  failed (%s): %d", reason, r.failures[reason])
+	}
+	log.Infof("  documents in index before:  %d", r.before)
+	log.Infof("  documents in index after:   %d", r.final)
+}
+
+// check returns an error if the numbers of the report do not add up. Every
+// document read has to be indexed, or already exist when creating. When
+// creating, or when the index was empty, the index has to grow by the
+// number of documents indexed. Otherwise documents may have been
+// overwritten, so the index has to hold at least that many.
+func (r restoreReport) check() error {
+	var failed uint64
+	for _, n := range r.failures {
+		failed += n
+	}
+	if failed > 0 || r.indexed+r.existing != r.read {
+		return fmt.Errorf("restore of %s incomplete: %d documents read, %d indexed, %d already present, %d failed",
+			r.index, r.read, r.indexed, r.existing, failed)
+	}
+
+	if r.action == "create" || r.before == 0 {
+		if r.final != r.before+int64(r.indexed) {
+			return fmt.Errorf("index %s holds %d documents, expected %d", r.index, r.final, r.before+int64(r.indexed))
+		}
+
+		return nil
+	}
+	if r.final < int64(r.indexed) || r.final > r.before+int64(r.indexed) {
+		return fmt.Errorf("index %s holds %d documents, expected between %d and %d",
+			r.index, r.final, r.indexed, r.before+int64(r.indexed))
 	}
 
 	return nil
 }
 
-func (es *esClient) restoreDocuments(sb *s3Backend, privateKeyPath, fileName, c4ghPassword string) error {
-	var countSuccessful uint64
+func (es *esClient) restoreDocuments(sb *s3Backend, privateKeys keySource, fileName string) error {
+	action := "index"
+	if es.conf.restoreMode != "" {
+		action = es.conf.restoreMode
+	}
+	if action != "index" && action != "create" {
+		return fmt.Errorf("unknown restore mode: %s", action)
+	}
+
+	log.Infof("restoring index with name %s", fileName)
 
-	err := es.countDocuments(fileName)
+	privateKey, err := privateKeys.privateKey()
 	if err != nil {
+		return fmt.Errorf("could not retrieve private key: %s", err)
+	}
+
+	log.Debug("Private key retrieved")
+
+	if _, err := sb.checkKey(fileName, privateKey); err != nil {
 		return err
 	}
 
-	log.Infof("restoring index with name %s", fileName)
+	workers := 1
+	if es.conf.bulkWorkers > 0 {
+		workers = es.conf.bulkWorkers
+	}
+	flushBytes := 2048
+	if es.conf.bulkFlushBytes > 0 {
+		flushBytes = es.conf.bulkFlushBytes
+	}
 
-	fr, err := sb.NewFileReader(fileName)
+	// backups without metadata only have the object name to go by
+	indexName := es.targetIndex(strings.TrimPrefix(strings.TrimSuffix(fileName, filepath.Ext(fileName)), es.conf.filePrefix))
+	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        es.client,
+		NumWorkers:    workers,
+		FlushBytes:    flushBytes,
+		FlushInterval: 30 * time.Second,
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("unexpected error: %s", err)
 	}
-	defer fr.Close()
 
-	privateKey, err := getPrivateKey(privateKeyPath, c4ghPassword)
+	run := &restoreRun{es: es, bi: bi, index: indexName, action: action, failures: make(map[string]uint64)}
+	parts, err := run.restoreObject(sb, privateKey, fileName)
+	if err == nil && len(parts) > 0 {
+		err = run.restoreParts(sb, privateKey, parts)
+	}
 	if err != nil {
-		return fmt.Errorf("could not retrieve private key: %s", err)
+		_ = bi.Close(context.Background())
+
+		return err
 	}
 
-	log.Debug("Private key retrieved")
+	if err := bi.Close(context.Background()); err != nil {
+		return fmt.Errorf("could not flush bulk indexer: %s", err)
+	}
 
-	r, err := newDecryptor(privateKey, fr)
-	if err != nil {
-		return fmt.Errorf("could not initialise decryptor: %s", err)
+	if err := run.countBefore(); err != nil {
+		return err
 	}
-	d, err := newDecompressor(r)
+	res, err := es.client.Indices.Refresh(es.client.Indices.Refresh.WithIndex(run.index))
 	if err != nil {
-		return fmt.Errorf("could not initialise decompressor: %s", err)
+		return fmt.Errorf("could not refresh %s: %s", run.index, err)
 	}
-	data, err := io.ReadAll(d)
+	res.Body.Close()
+	final, err := es.countDocuments(run.index)
 	if err != nil {
-		return fmt.Errorf("could not read all data: %s", err)
+		return err
 	}
 
-	if err := d.Close(); err != nil {
-		log.Errorf("could not close decompressor: %v", err)
+	report := restoreReport{
+		index:    run.index,
+		action:   run.action,
+		read:     atomic.LoadUint64(&run.read),
+		indexed:  atomic.LoadUint64(&run.successful),
+		existing: atomic.LoadUint64(&run.existing),
+		failures: run.failures,
+		before:   run.before,
+		final:    final,
+	}
+	report.log()
+	if err := report.check(); err != nil {
+		return err
 	}
 
-	if err := r.Close(); err != nil {
-		log.Errorf("could not close decryptor: %v", err)
+	if es.conf.restoreAlias != "" {
+		return es.switchAlias(es.conf.restoreAlias, run.index)
 	}
 
-	ud := string(data)
+	return nil
+}
 
-	indexName := strings.TrimSuffix(fileName, filepath.Ext(fileName))
-	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		Index:         indexName,
-		Client:        es.client,
-		NumWorkers:    1,
-		FlushBytes:    int(2048),
-		FlushInterval: 30 * time.Second,
-	})
+// restoreParts restores the part objects of a backup in parallel
+func (run *restoreRun) restoreParts(sb *s3Backend, privateKey [32]byte, parts []string) error {
+	log.Infof("Restoring %d parts", len(parts))
+	errs := make([]error, len(parts))
+	wg := sync.WaitGroup{}
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part string) {
+			defer wg.Done()
+			if _, err := run.restoreObject(sb, privateKey, part); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", part, err)
+			}
+		}(i, part)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// restoreObject streams the documents of one backup object into the bulk
+// indexer. If the object starts with a metadata header the target index is
+// created from it, and the parts listed in the header are returned.
+func (run *restoreRun) restoreObject(sb *s3Backend, privateKey [32]byte, name string) ([]string, error) {
+	r, err := newBackupReader(sb, privateKey, name)
 	if err != nil {
-		return fmt.Errorf("unexpected error: %s", err)
+		return nil, err
 	}
-	defer bi.Close(context.Background())
+	defer r.Close()
 
-	for _, docs := range strings.Split(ud, "\n") {
-		if docs == "" {
-			log.Debug("End of blob reached")
+	var parts []string
 
-			break
+	// Each line of the backup holds the hits of one scroll batch, so only a
+	// single batch is kept in memory while the documents are indexed.
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not read backup: %s", err)
 		}
-		i := 0
-		for {
-			key := fmt.Sprintf("%v._source", i)
-			source := gjson.Get(docs, key).String()
 
-			if source == "" {
-				break
+		docs := strings.TrimSpace(line)
+		if strings.HasPrefix(docs, "{") {
+			header := backupHeader{}
+			if err := json.Unmarshal([]byte(docs), &header); err != nil || header.Metadata == nil {
+				return nil, fmt.Errorf("could not parse backup metadata: %v", err)
 			}
-
-			err = bi.Add(
-				context.Background(),
-				esutil.BulkIndexerItem{
-					Action: "index",
-					Body:   strings.NewReader(source),
-					OnSuccess: func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem) {
-						atomic.AddUint64(&countSuccessful, 1)
-					},
-					OnFailure: func(_ context.Context, _ esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
-						if err != nil {
-							log.Errorf("Error: %s", err)
-						} else {
-							log.Errorf("Error: %s: %s", res.Error.Type, res.Error.Reason)
-						}
-					},
-				},
-			)
-			if err != nil {
-				return fmt.Errorf("unexpected error: %s", err)
+			if header.Query != nil {
+				log.Infof("%s is a partial backup of %s, holding the documents matching: %s", name, header.Metadata.Index, header.Query)
+			}
+			run.index = run.es.targetIndex(header.Metadata.Index)
+			if header.DataStream {
+				// data streams only accept creates, the stream itself is
+				// created from its index template by the first document
+				log.Infof("Restoring into data stream %s", run.index)
+				run.action = "create"
+			} else if err := run.es.createIndex(run.index, header.Metadata); err != nil {
+				return nil, err
+			}
+			parts = header.Parts
+		} else if docs != "" {
+			if err := run.addHits(docs); err != nil {
+				return nil, err
 			}
-			i++
 		}
+
+		if err == io.EOF {
+			log.Debugf("End of %s reached", name)
+
+			return parts, nil
+		}
+	}
+}
+
+// addHits adds a batch of hits from a backup to the bulk indexer
+func (run *restoreRun) addHits(docs string) error {
+	if err := run.countBefore(); err != nil {
+		return err
+	}
+
+	var addErr error
+	gjson.Parse(docs).ForEach(func(_, hit gjson.Result) bool {
+		atomic.AddUint64(&run.read, 1)
+		addErr = run.bi.Add(
+			context.Background(),
+			esutil.BulkIndexerItem{
+				Index:      run.index,
+				Action:     run.action,
+				DocumentID: hit.Get("_id").String(),
+				Routing:    hit.Get("_routing").String(),
+				Body:       strings.NewReader(hit.Get("_source").Raw),
+				OnSuccess: func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem) {
+					atomic.AddUint64(&run.successful, 1)
+				},
+				OnFailure: func(_ context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+					switch {
+					case err != nil:
+						log.Errorf("Error: %s", err)
+						run.addFailure("request error")
+					case run.action == "create" && res.Status == http.StatusConflict:
+						log.Tracef("Document %s already exists", item.DocumentID)
+						atomic.AddUint64(&run.existing, 1)
+					default:
+						log.Errorf("Error: %s: %s", res.Error.Type, res.Error.Reason)
+						run.addFailure(res.Error.Type)
+					}
+				},
+			},
+		)
+
+		return addErr == nil
+	})
+	if addErr != nil {
+		return fmt.Errorf("unexpected error: %s", addErr)
 	}
 
 	return nil
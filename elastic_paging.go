@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/tidwall/gjson"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hitPager returns the documents of an index one batch of hits at a time,
+// an empty batch marks the end of the index.
+type hitPager interface {
+	next() (gjson.Result, error)
+	// close releases the search context held by the pager
+	close()
+}
+
+// keepAliveString formats a keepalive the way Elasticsearch expects it
+func keepAliveString(d time.Duration) string {
+	return fmt.Sprintf("%ds", int(d.Seconds()))
+}
+
+// newPager returns a pager for the documents of an index that match query,
+// or for all documents when query is nil. With pagination set to "pit" a
+// point in time is used, clusters that do not support it fall back to
+// sliced scrolling.
+func (es esClient) newPager(index string, size int, query json.RawMessage) hitPager {
+	if es.conf.pagination == "pit" {
+		p, err := es.openPointInTime(index, size, query)
+		if err == nil {
+			return p
+		}
+		log.Warnf("Point in time not available, falling back to sliced scroll: %v", err)
+	}
+
+	slices := es.conf.slices
+	if slices < 1 {
+		slices = 1
+	}
+
+	return &slicedScrollPager{es: es, index: index, size: size, query: query, slices: slices}
+}
+
+// scrollPager pages through an index, or one slice of it, with the scroll API
+type scrollPager struct {
+	es        esClient
+	index     string
+	size      int
+	query     json.RawMessage
+	slice     int
+	maxSlices int
+	scrollID  string
+}
+
+func (p *scrollPager) next() (gjson.Result, error) {
+	var (
+		res *esapi.Response
+		err error
+	)
+
+	keepAlive := p.es.conf.keepAlive
+	if p.scrollID == "" {
+		search := p.es.client.Search
+		opts := []func(*esapi.SearchRequest){
+			search.WithIndex(p.index),
+			search.WithSize(p.size),
+			search.WithSort("_doc"),
+			search.WithScroll(keepAlive),
+		}
+		body := map[string]interface{}{}
+		if p.maxSlices > 1 {
+			body["slice"] = map[string]int{"id": p.slice, "max": p.maxSlices}
+		}
+		if p.query != nil {
+			body["query"] = p.query
+		}
+		if len(body) > 0 {
+			data, err := json.Marshal(body)
+			if err != nil {
+				return gjson.Result{}, err
+			}
+			opts = append(opts, search.WithBody(bytes.NewReader(data)))
+		}
+		res, err = search(opts...)
+	} else {
+		res, err = p.es.client.Scroll(p.es.client.Scroll.WithScrollID(p.scrollID), p.es.client.Scroll.WithScroll(keepAlive))
+	}
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	body := readResponse(res.Body)
+	if err := res.Body.Close(); err != nil {
+		return gjson.Result{}, fmt.Errorf("error while closing response: %v", err)
+	}
+	if res.IsError() {
+		return gjson.Result{}, fmt.Errorf("error response: %s", body)
+	}
+
+	p.scrollID = gjson.Get(body, "_scroll_id").String()
+	log.Trace("ScrollID", p.scrollID)
+
+	return gjson.Get(body, "hits.hits"), nil
+}
+
+func (p *scrollPager) close() {
+	if p.scrollID == "" {
+		return
+	}
+
+	res, err := p.es.client.ClearScroll(p.es.client.ClearScroll.WithScrollID(p.scrollID))
+	if err != nil {
+		log.Warnf("Could not clear scroll context: %v", err)
+
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Warnf("Could not clear scroll context: %s", readResponse(res.Body))
+	}
+	p.scrollID = ""
+}
+
+// slicedScrollPager reads the slices of an index one after the other, so
+// that each scroll context is only kept alive while its slice is read.
+type slicedScrollPager struct {
+	es      esClient
+	index   string
+	size    int
+	query   json.RawMessage
+	slices  int
+	current *scrollPager
+}
+
+func (p *slicedScrollPager) next() (gjson.Result, error) {
+	for {
+		if p.current == nil {
+			p.current = &scrollPager{es: p.es, index: p.index, size: p.size, query: p.query, maxSlices: p.slices}
+		}
+
+		hits, err := p.current.next()
+		if err != nil || len(hits.Array()) > 0 || p.current.slice+1 >= p.slices {
+			return hits, err
+		}
+
+		slice := p.current.slice + 1
+		p.current.close()
+		p.current = &scrollPager{es: p.es, index: p.index, size: p.size, query: p.query, slice: slice, maxSlices: p.slices}
+	}
+}
+
+func (p *slicedScrollPager) close() {
+	if p.current != nil {
+		p.current.close()
+	}
+}
+
+// pitPager pages through an index using a point in time and search_after,
+// which gives a consistent view of the index for as long as it is read.
+type pitPager struct {
+	es          esClient
+	size        int
+	query       json.RawMessage
+	pitID       string
+	searchAfter json.RawMessage
+}
+
+func (es esClient) openPointInTime(index string, size int, query json.RawMessage) (*pitPager, error) {
+	res, err := es.client.OpenPointInTime([]string{index}, keepAliveString(es.conf.keepAlive))
+	if err != nil {
+		return nil, err
+	}
+
+	body := readResponse(res.Body)
+	if err := res.Body.Close(); err != nil {
+		return nil, fmt.Errorf("error while closing response: %v", err)
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("error response: %s", body)
+	}
+
+	return &pitPager{es: es, size: size, query: query, pitID: gjson.Get(body, "id").String()}, nil
+}
+
+func (p *pitPager) next() (gjson.Result, error) {
+	query := map[string]interface{}{
+		"size": p.size,
+		"pit": map[string]string{
+			"id":         p.pitID,
+			"keep_alive": keepAliveString(p.es.conf.keepAlive),
+		},
+		"sort":             []map[string]string{{"_shard_doc": "asc"}},
+		"track_total_hits": false,
+	}
+	if p.searchAfter != nil {
+		query["search_after"] = p.searchAfter
+	}
+	if p.query != nil {
+		query["query"] = p.query
+	}
+
+	data, err := json.Marshal(query)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	res, err := p.es.client.Search(p.es.client.Search.WithBody(bytes.NewReader(data)))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	body := readResponse(res.Body)
+	if err := res.Body.Close(); err != nil {
+		return gjson.Result{}, fmt.Errorf("error while closing response: %v", err)
+	}
+	if res.IsError() {
+		return gjson.Result{}, fmt.Errorf("error response: %s", body)
+	}
+
+	if id := gjson.Get(body, "pit_id").String(); id != "" {
+		p.pitID = id
+	}
+
+	hits := gjson.Get(body, "hits.hits")
+	if batch := hits.Array(); len(batch) > 0 {
+		p.searchAfter = json.RawMessage(batch[len(batch)-1].Get("sort").Raw)
+	}
+
+	return hits, nil
+}
+
+func (p *pitPager) close() {
+	body := fmt.Sprintf(`{"id":%q}`, p.pitID)
+	res, err := p.es.client.ClosePointInTime(p.es.client.ClosePointInTime.WithBody(bytes.NewReader([]byte(body))))
+	if err != nil {
+		log.Warnf("Could not close point in time: %v", err)
+
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Warnf("Could not close point in time: %s", readResponse(res.Body))
+	}
+}
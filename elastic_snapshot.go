@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotInfo describes a snapshot in the snapshot repository
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	State   string    `json:"state"`
+	Started time.Time `json:"started"`
+	Indices []string  `json:"indices"`
+}
+
+// snapshotRepository returns the name of the snapshot repository
+func (es esClient) snapshotRepository() string {
+	if es.conf.snapshotRepository != "" {
+		return es.conf.snapshotRepository
+	}
+
+	return "backup-svc"
+}
+
+// registerSnapshotRepository registers an S3 snapshot repository that stores
+// the snapshots under `snapshots` in the PathPrefix of the backup bucket. The
+// credentials and endpoint of the bucket are read by Elasticsearch from the
+// settings of the configured S3 client, they are not part of the repository.
+func (es esClient) registerSnapshotRepository(s3Conf S3Config) error {
+	basePath := es.conf.snapshotBasePath
+	if basePath == "" {
+		basePath = path.Join(s3Conf.PathPrefix, "snapshots")
+	}
+	client := es.conf.snapshotClient
+	if client == "" {
+		client = "default"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type": "s3",
+		"settings": map[string]string{
+			"bucket":    s3Conf.Bucket,
+			"base_path": basePath,
+			"client":    client,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := es.client.Snapshot.CreateRepository(es.snapshotRepository(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not register snapshot repository: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not register snapshot repository: %s", readResponse(res.Body))
+	}
+	log.Infof("Snapshot repository %s registered in bucket %s under %s", es.snapshotRepository(), s3Conf.Bucket, basePath)
+
+	return nil
+}
+
+// createSnapshot takes a snapshot of the indices that match the glob and
+// waits for it to finish
+func (es esClient) createSnapshot(indexGlob string) error {
+	indices, err := findIndices(es, indexGlob)
+	if err != nil {
+		return err
+	}
+
+	name := "snapshot-" + time.Now().Format(backupTimeFormat)
+	body, err := json.Marshal(map[string]interface{}{
+		"indices":              strings.Join(indices, ","),
+		"include_global_state": false,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Creating snapshot %s of %d indices", name, len(indices))
+	snapshot := es.client.Snapshot.Create
+	res, err := snapshot(es.snapshotRepository(), name, snapshot.WithBody(bytes.NewReader(body)), snapshot.WithWaitForCompletion(true))
+	if err != nil {
+		return fmt.Errorf("could not create snapshot: %s", err)
+	}
+	defer res.Body.Close()
+
+	response := readResponse(res.Body)
+	if res.IsError() {
+		return fmt.Errorf("could not create snapshot: %s", response)
+	}
+	if state := gjson.Get(response, "snapshot.state").String(); state != "SUCCESS" {
+		return fmt.Errorf("snapshot %s finished with state %s: %s", name, state, gjson.Get(response, "snapshot.failures").Raw)
+	}
+	log.Infof("Snapshot %s created", name)
+
+	return nil
+}
+
+// listSnapshots returns the snapshots in the repository, oldest first
+func (es esClient) listSnapshots() ([]snapshotInfo, error) {
+	res, err := es.client.Snapshot.Get(es.snapshotRepository(), []string{"_all"})
+	if err != nil {
+		return nil, fmt.Errorf("could not list snapshots: %s", err)
+	}
+	defer res.Body.Close()
+
+	response := readResponse(res.Body)
+	if res.IsError() {
+		return nil, fmt.Errorf("could not list snapshots: %s", response)
+	}
+
+	var snapshots []snapshotInfo
+	for _, s := range gjson.Get(response, "snapshots").Array() {
+		info := snapshotInfo{
+			Name:    s.Get("snapshot").String(),
+			State:   s.Get("state").String(),
+			Started: time.UnixMilli(s.Get("start_time_in_millis").Int()).UTC(),
+		}
+		for _, index := range s.Get("indices").Array() {
+			info.Indices = append(info.Indices, index.String())
+		}
+		snapshots = append(snapshots, info)
+	}
+
+	return snapshots, nil
+}
+
+// printSnapshots writes the snapshots as either a table or JSON
+func printSnapshots(w io.Writer, snapshots []snapshotInfo, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(snapshots)
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSTATE\tSTARTED\tINDICES")
+		for _, s := range snapshots {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.Name, s.State, s.Started.Format(time.RFC3339), strings.Join(s.Indices, ","))
+		}
+
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// resolveSnapshotName returns the snapshot to use, "latest" selects the
+// newest successful snapshot in the repository
+func (es esClient) resolveSnapshotName(name string) (string, error) {
+	if name != "latest" {
+		return name, nil
+	}
+
+	snapshots, err := es.listSnapshots()
+	if err != nil {
+		return "", err
+	}
+
+	var selected *snapshotInfo
+	for i, s := range snapshots {
+		if s.State == "SUCCESS" && (selected == nil || s.Started.After(selected.Started)) {
+			selected = &snapshots[i]
+		}
+	}
+	if selected == nil {
+		return "", fmt.Errorf("no successful snapshot found in %s", es.snapshotRepository())
+	}
+	log.Infof("Selected snapshot %s from %s", selected.Name, selected.Started.Format(time.RFC3339))
+
+	return selected.Name, nil
+}
+
+// restoreSnapshot restores the indices of a snapshot that match indexGlob,
+// or all of them when it is empty. An index that exists and is open can not
+// be restored over, so restoreSuffix can be used to restore next to the live
+// indices. Aliases are then left out, as they are for document restores into
+// a different index.
+func (es esClient) restoreSnapshot(name, indexGlob string) error {
+	name, err := es.resolveSnapshotName(name)
+	if err != nil {
+		return err
+	}
+
+	request := map[string]interface{}{
+		"include_global_state": false,
+	}
+	if indexGlob != "" {
+		request["indices"] = indexGlob
+	}
+	if es.conf.restoreSuffix != "" {
+		request["rename_pattern"] = "(.+)"
+		request["rename_replacement"] = "$1" + es.conf.restoreSuffix
+		request["include_aliases"] = false
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restoring indices matching %q from snapshot %s", indexGlob, name)
+	restore := es.client.Snapshot.Restore
+	res, err := restore(es.snapshotRepository(), name, restore.WithBody(bytes.NewReader(body)), restore.WithWaitForCompletion(true))
+	if err != nil {
+		return fmt.Errorf("could not restore snapshot: %s", err)
+	}
+	defer res.Body.Close()
+
+	response := readResponse(res.Body)
+	if res.IsError() {
+		return fmt.Errorf("could not restore snapshot: %s", response)
+	}
+	if failed := gjson.Get(response, "snapshot.shards.failed").Int(); failed > 0 {
+		return fmt.Errorf("restore of snapshot %s failed for %d shards", name, failed)
+	}
+	log.Infof("Restored indices %s", gjson.Get(response, "snapshot.indices").Raw)
+
+	return nil
+}
+
+// deleteSnapshot removes a snapshot from the repository
+func (es esClient) deleteSnapshot(name string) error {
+	res, err := es.client.Snapshot.Delete(es.snapshotRepository(), name)
+	if err != nil {
+		return fmt.Errorf("could not delete snapshot: %s", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not delete snapshot %s: %s", name, readResponse(res.Body))
+	}
+	log.Infof("Snapshot %s deleted", name)
+
+	return nil
+}
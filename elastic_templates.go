@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/tidwall/gjson"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// templatesSuffix is the extension of template backups
+const templatesSuffix = ".tpl"
+
+// clusterTemplates holds the ILM policies, component templates and index
+// templates of a cluster, each stored as the body that recreates it.
+type clusterTemplates struct {
+	ILMPolicies        map[string]json.RawMessage `json:"ilm_policies"`
+	ComponentTemplates map[string]json.RawMessage `json:"component_templates"`
+	IndexTemplates     map[string]json.RawMessage `json:"index_templates"`
+}
+
+// templateResponse returns the body of a response, a 404 gives an empty object
+func templateResponse(what string, res *esapi.Response, err error) (string, error) {
+	if err != nil {
+		return "", fmt.Errorf("could not get %s: %s", what, err)
+	}
+	defer res.Body.Close()
+
+	body := readResponse(res.Body)
+	if res.StatusCode == http.StatusNotFound {
+		return "{}", nil
+	}
+	if res.IsError() {
+		return "", fmt.Errorf("could not get %s: %s", what, body)
+	}
+
+	return body, nil
+}
+
+// wantTemplate reports if a template or policy is backed up. Templates and
+// policies that are managed by Elasticsearch itself are left out.
+func wantTemplate(glob, name string, definition gjson.Result) bool {
+	if strings.HasPrefix(name, ".") || definition.Get("_meta.managed").Bool() {
+		return false
+	}
+	ok, err := path.Match(glob, name)
+
+	return err == nil && ok
+}
+
+// getTemplates returns the ILM policies and templates whose names match the glob
+func (es esClient) getTemplates(glob string) (*clusterTemplates, error) {
+	if glob == "" {
+		glob = "*"
+	}
+	templates := &clusterTemplates{
+		ILMPolicies:        make(map[string]json.RawMessage),
+		ComponentTemplates: make(map[string]json.RawMessage),
+		IndexTemplates:     make(map[string]json.RawMessage),
+	}
+
+	res, err := es.client.ILM.GetLifecycle()
+	body, err := templateResponse("ILM policies", res, err)
+	if err != nil {
+		return nil, err
+	}
+	gjson.Parse(body).ForEach(func(name, policy gjson.Result) bool {
+		if wantTemplate(glob, name.String(), policy.Get("policy")) {
+			templates.ILMPolicies[name.String()] = json.RawMessage(`{"policy":` + policy.Get("policy").Raw + `}`)
+		}
+
+		return true
+	})
+
+	res, err = es.client.Cluster.GetComponentTemplate()
+	body, err = templateResponse("component templates", res, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range gjson.Get(body, "component_templates").Array() {
+		if wantTemplate(glob, t.Get("name").String(), t.Get("component_template")) {
+			templates.ComponentTemplates[t.Get("name").String()] = json.RawMessage(t.Get("component_template").Raw)
+		}
+	}
+
+	res, err = es.client.Indices.GetIndexTemplate()
+	body, err = templateResponse("index templates", res, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range gjson.Get(body, "index_templates").Array() {
+		if wantTemplate(glob, t.Get("name").String(), t.Get("index_template")) {
+			templates.IndexTemplates[t.Get("name").String()] = json.RawMessage(t.Get("index_template").Raw)
+		}
+	}
+
+	log.Infof("Found %d ILM policies, %d component templates and %d index templates",
+		len(templates.ILMPolicies), len(templates.ComponentTemplates), len(templates.IndexTemplates))
+
+	return templates, nil
+}
+
+// backupTemplates writes the ILM policies and templates matching the glob to
+// an encrypted backup object
+func (es esClient) backupTemplates(sb *s3Backend, publicKeyPaths []string, signingKeyPath, glob string) error {
+	templates, err := es.getTemplates(glob)
+	if err != nil {
+		return err
+	}
+
+	privateKey, publicKeyList, err := getKeys(publicKeyPaths)
+	if err != nil {
+		return fmt.Errorf("could not retrieve public key or generate private key: %s", err)
+	}
+
+	bw := backupWriter{
+		sb:             sb,
+		publicKeyList:  publicKeyList,
+		privateKey:     privateKey,
+		signingKeyPath: signingKeyPath,
+		esVersion:      es.clusterVersion(),
+	}
+
+	name := time.Now().Format(backupTimeFormat) + "-es-templates" + templatesSuffix
+	err = bw.write(name, "templates", func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(templates)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Templates backed up to %s", name)
+
+	return nil
+}
+
+// restoreTemplates recreates the ILM policies and templates of a backup.
+// Policies go first since templates refer to them, and component templates
+// before the index templates that are composed of them.
+func (es esClient) restoreTemplates(sb *s3Backend, privateKeys keySource, name string) error {
+	privateKey, err := privateKeys.privateKey()
+	if err != nil {
+		return fmt.Errorf("could not retrieve private key: %s", err)
+	}
+
+	if _, err := sb.checkKey(name, privateKey); err != nil {
+		return err
+	}
+
+	r, err := newBackupReader(sb, privateKey, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	templates := clusterTemplates{}
+	if err := json.NewDecoder(r).Decode(&templates); err != nil {
+		return fmt.Errorf("could not parse templates: %s", err)
+	}
+
+	for _, policy := range sortedNames(templates.ILMPolicies) {
+		put := es.client.ILM.PutLifecycle
+		res, err := put(policy, put.WithBody(bytes.NewReader(templates.ILMPolicies[policy])))
+		if err := checkPut("ILM policy "+policy, res, err); err != nil {
+			return err
+		}
+	}
+
+	for _, template := range sortedNames(templates.ComponentTemplates) {
+		res, err := es.client.Cluster.PutComponentTemplate(template, bytes.NewReader(templates.ComponentTemplates[template]))
+		if err := checkPut("component template "+template, res, err); err != nil {
+			return err
+		}
+	}
+
+	for _, template := range sortedNames(templates.IndexTemplates) {
+		res, err := es.client.Indices.PutIndexTemplate(template, bytes.NewReader(templates.IndexTemplates[template]))
+		if err := checkPut("index template "+template, res, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPut turns a failed put of a template or policy into an error
+func checkPut(what string, res *esapi.Response, err error) error {
+	if err != nil {
+		return fmt.Errorf("could not restore %s: %s", what, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("could not restore %s: %s", what, readResponse(res.Body))
+	}
+	log.Infof("Restored %s", what)
+
+	return nil
+}
+
+func sortedNames(m map[string]json.RawMessage) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
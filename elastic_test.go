@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupQuery(t *testing.T) {
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name   string
+		conf   elasticConfig
+		query  string
+		errMsg string
+	}{
+		{
+			name: "whole index",
+		},
+		{
+			name:  "query only",
+			conf:  elasticConfig{query: `{"term":{"user":"admin"}}`},
+			query: `{"term":{"user":"admin"}}`,
+		},
+		{
+			name:  "range only",
+			conf:  elasticConfig{timeField: "@timestamp", since: 24 * time.Hour},
+			query: `{"bool":{"filter":[{"range":{"@timestamp":{"gte":"2024-05-01T12:00:00Z","lt":"2024-05-02T12:00:00Z"}}}]}}`,
+		},
+		{
+			name:  "query and range",
+			conf:  elasticConfig{query: `{"term":{"user":"admin"}}`, timeField: "ts", since: 2 * time.Hour, until: time.Hour},
+			query: `{"bool":{"filter":[{"term":{"user":"admin"}},{"range":{"ts":{"gte":"2024-05-02T10:00:00Z","lt":"2024-05-02T11:00:00Z"}}}]}}`,
+		},
+		{
+			name:   "invalid query",
+			conf:   elasticConfig{query: `{"term":`},
+			errMsg: "not valid JSON",
+		},
+		{
+			name:   "range without since",
+			conf:   elasticConfig{timeField: "ts"},
+			errMsg: "since is not",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := esClient{conf: test.conf}.backupQuery(now)
+			if test.errMsg != "" {
+				assert.ErrorContains(t, err, test.errMsg)
+
+				return
+			}
+			assert.NoError(t, err)
+			if test.query == "" {
+				assert.Nil(t, query)
+
+				return
+			}
+			assert.JSONEq(t, test.query, string(query))
+		})
+	}
+}
+
+func TestParsePartialBackupName(t *testing.T) {
+	full, ok := parseBackupName("es-logs.bup", time.Time{})
+	assert.True(t, ok)
+	assert.Equal(t, "es-logs", full.Source)
+
+	partial, ok := parseBackupName("es-logs"+partialBackupSuffix+"20240502120000.bup", time.Time{})
+	assert.True(t, ok)
+	assert.Equal(t, "es-logs.partial", partial.Source)
+	assert.Equal(t, time.Date(2024, 5, 2, 12, 0, 0, 0, time.Local), partial.Timestamp)
+}
+
+func TestRestoreReportCheck(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		report restoreReport
+		errMsg string
+	}{
+		{
+			name:   "create into populated index",
+			report: restoreReport{action: "create", read: 10, indexed: 6, existing: 4, before: 20, final: 26},
+		},
+		{
+			name:   "create with documents lost",
+			report: restoreReport{action: "create", read: 10, indexed: 6, existing: 4, before: 20, final: 25},
+			errMsg: "holds 25 documents, expected 26",
+		},
+		{
+			name:   "index into empty index",
+			report: restoreReport{action: "index", read: 10, indexed: 10, final: 10},
+		},
+		{
+			name:   "index into empty index with documents lost",
+			report: restoreReport{action: "index", read: 10, indexed: 10, final: 9},
+			errMsg: "holds 9 documents, expected 10",
+		},
+		{
+			name:   "index into populated index overwriting all",
+			report: restoreReport{action: "index", read: 10, indexed: 10, before: 10, final: 10},
+		},
+		{
+			name:   "index into populated index adding all",
+			report: restoreReport{action: "index", read: 10, indexed: 10, before: 5, final: 15},
+		},
+		{
+			name:   "index into populated index with documents lost",
+			report: restoreReport{action: "index", read: 10, indexed: 10, before: 5, final: 8},
+			errMsg: "expected between 10 and 15",
+		},
+		{
+			name:   "index into populated index with too many documents",
+			report: restoreReport{action: "index", read: 10, indexed: 10, before: 5, final: 16},
+			errMsg: "expected between 10 and 15",
+		},
+		{
+			name:   "failed documents",
+			report: restoreReport{action: "index", read: 10, indexed: 9, failures: map[string]uint64{"mapper_parsing_exception": 1}, final: 9},
+			errMsg: "incomplete: 10 documents read, 9 indexed, 0 already present, 1 failed",
+		},
+		{
+			name:   "documents not indexed",
+			report: restoreReport{action: "create", read: 10, indexed: 8, existing: 1, final: 8},
+			errMsg: "incomplete",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.report.check()
+			if test.errMsg != "" {
+				assert.ErrorContains(t, err, test.errMsg)
+
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
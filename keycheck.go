@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	log "github.com/sirupsen/logrus"
+)
+
+// headerRangeSize is the number of bytes fetched to read a crypt4gh header,
+// far more than the header of a backup with a handful of recipients needs
+const headerRangeSize = 64 * 1024
+
+// errStopWalk ends a walk of the bucket early
+var errStopWalk = errors.New("stop walking the bucket")
+
+// checkKey fetches only the crypt4gh header of a backup and checks that the
+// private key can decrypt it. It returns the fingerprint of the recipient
+// key that matched.
+func (sb *s3Backend) checkKey(name string, privateKey [32]byte) (string, error) {
+	obj, err := sb.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(name),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", headerRangeSize-1)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not fetch header of %s: %s", name, err)
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch header of %s: %s", name, err)
+	}
+	header, err := headers.ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("could not read crypt4gh header of %s: %s", name, err)
+	}
+	// the packet count follows the magic number and the version
+	packets := binary.LittleEndian.Uint32(header[12:16])
+
+	if _, err := headers.NewHeader(bytes.NewReader(header), privateKey); err != nil {
+		return "", fmt.Errorf("private key can not decrypt %s, it is encrypted to %d recipients none of which matches: %s", name, packets, err)
+	}
+
+	fingerprint := keyFingerprint(keys.DerivePublicKey(privateKey))
+	log.Infof("%s: private key matches recipient %s, one of %d header packets", name, fingerprint, packets)
+
+	if sb.objectExists(name + manifestSuffix) {
+		manifest, err := sb.readManifest(name)
+		if err != nil {
+			return "", fmt.Errorf("could not read manifest of %s: %s", name, err)
+		}
+		for i, recipient := range manifest.Recipients {
+			if recipient == fingerprint {
+				log.Infof("%s: recipient %d of %d listed in the manifest", name, i+1, len(manifest.Recipients))
+
+				return fingerprint, nil
+			}
+		}
+		log.Warnf("%s: matching recipient %s is not listed in the manifest", name, fingerprint)
+	}
+
+	return fingerprint, nil
+}
+
+// checkKeys checks the private key against the header of a backup, or of
+// every encrypted backup under the PathPrefix when name is empty.
+func checkKeys(sb *s3Backend, privateKey [32]byte, name string) error {
+	if name != "" {
+		_, err := sb.checkKey(name, privateKey)
+
+		return err
+	}
+
+	return transferObjects(sb, "check_keys", func(obj *s3.Object) (bool, error) {
+		if !isEncryptedBackup(*obj.Key) {
+			return false, nil
+		}
+		_, err := sb.checkKey(*obj.Key, privateKey)
+
+		return true, err
+	})
+}
+
+// checkFirstKey checks the private key against the first encrypted object of
+// a bucket backup, so that a bucket restore fails before it starts with a
+// key that can not read the backup
+func checkFirstKey(sb *s3Backend, privateKey [32]byte) error {
+	err := sb.walkBucket(func(obj *s3.Object) error {
+		if !isEncryptedBackup(*obj.Key) {
+			return nil
+		}
+		if _, err := sb.checkKey(*obj.Key, privateKey); err != nil {
+			return err
+		}
+
+		return errStopWalk
+	})
+	if errors.Is(err, errStopWalk) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/tidwall/gjson"
+)
+
+// keySource provides the crypt4gh private key used to decrypt backups
+type keySource interface {
+	privateKey() ([32]byte, error)
+}
+
+// passphrase is the passphrase of a private key, given either as a value or
+// as a file holding it
+type passphrase struct {
+	value string
+	file  string
+}
+
+func (p passphrase) get() (string, error) {
+	if p.file == "" {
+		return p.value, nil
+	}
+
+	data, err := os.ReadFile(filepath.Clean(p.file))
+	if err != nil {
+		return "", fmt.Errorf("could not read passphrase file: %s", err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// readPrivateKeyPEM decrypts a crypt4gh private key given as PEM
+func readPrivateKeyPEM(pem string, pass passphrase) ([32]byte, error) {
+	password, err := pass.get()
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return keys.ReadPrivateKey(strings.NewReader(pem), []byte(password))
+}
+
+// fileKeySource reads the private key from a file
+type fileKeySource struct {
+	path       string
+	passphrase passphrase
+}
+
+func (s fileKeySource) privateKey() ([32]byte, error) {
+	password, err := s.passphrase.get()
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return getPrivateKey(s.path, password)
+}
+
+// envKeySource reads the private key, as PEM, from an environment variable
+type envKeySource struct {
+	variable   string
+	passphrase passphrase
+}
+
+func (s envKeySource) privateKey() ([32]byte, error) {
+	pem := os.Getenv(s.variable)
+	if pem == "" {
+		return [32]byte{}, fmt.Errorf("environment variable %s holds no private key", s.variable)
+	}
+
+	return readPrivateKeyPEM(pem, s.passphrase)
+}
+
+// httpKeySource fetches the private key from a secret manager, either a
+// Vault style HTTP endpoint or a local agent listening on a unix socket. The
+// key is taken from the field of the JSON response, or is the whole response
+// when no field is set.
+type httpKeySource struct {
+	url        string
+	socket     string
+	tokenFile  string
+	field      string
+	passphrase passphrase
+}
+
+func (s httpKeySource) privateKey() ([32]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if s.socket != "" {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+
+				return d.DialContext(ctx, "unix", s.socket)
+			},
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if s.tokenFile != "" {
+		token, err := os.ReadFile(filepath.Clean(s.tokenFile))
+		if err != nil {
+			return [32]byte{}, fmt.Errorf("could not read token file: %s", err)
+		}
+		req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("could not fetch private key: %s", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("could not read private key response: %s", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return [32]byte{}, fmt.Errorf("could not fetch private key: %s", res.Status)
+	}
+
+	pem := string(body)
+	if s.field != "" {
+		value := gjson.GetBytes(body, s.field)
+		if !value.Exists() {
+			return [32]byte{}, fmt.Errorf("private key response has no field %s", s.field)
+		}
+		pem = value.String()
+	}
+
+	return readPrivateKeyPEM(pem, s.passphrase)
+}
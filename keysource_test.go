@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neicnordic/crypt4gh/keys"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPrivateKey returns a key pair with the private key as passphrase protected PEM
+func testPrivateKey(t *testing.T, password string) ([32]byte, string) {
+	_, privateKey, err := keys.GenerateKeyPair()
+	assert.NoError(t, err)
+
+	var pem bytes.Buffer
+	assert.NoError(t, keys.WriteCrypt4GHX25519PrivateKey(&pem, privateKey, []byte(password)))
+
+	return privateKey, pem.String()
+}
+
+func TestFileKeySourceWithPassphraseFile(t *testing.T) {
+	privateKey, pem := testPrivateKey(t, "secret")
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "c4gh.sec.pem")
+	passPath := filepath.Join(dir, "passphrase")
+	assert.NoError(t, os.WriteFile(keyPath, []byte(pem), 0600))
+	assert.NoError(t, os.WriteFile(passPath, []byte("secret\n"), 0600))
+
+	key, err := fileKeySource{path: keyPath, passphrase: passphrase{file: passPath}}.privateKey()
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, key)
+
+	_, err = fileKeySource{path: keyPath, passphrase: passphrase{value: "wrong"}}.privateKey()
+	assert.Error(t, err)
+}
+
+func TestEnvKeySource(t *testing.T) {
+	privateKey, pem := testPrivateKey(t, "secret")
+	t.Setenv("TEST_C4GH_KEY", pem)
+
+	key, err := envKeySource{variable: "TEST_C4GH_KEY", passphrase: passphrase{value: "secret"}}.privateKey()
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, key)
+
+	_, err = envKeySource{variable: "TEST_C4GH_UNSET"}.privateKey()
+	assert.ErrorContains(t, err, "holds no private key")
+}
+
+func TestHTTPKeySource(t *testing.T) {
+	privateKey, pem := testPrivateKey(t, "secret")
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenPath, []byte("s.token\n"), 0600))
+
+	// a stand-in for a Vault KV v2 endpoint
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+		fmt.Fprintf(w, `{"data":{"data":{"key":%q}}}`, pem)
+	}))
+	defer vault.Close()
+
+	source := httpKeySource{url: vault.URL + "/v1/secret/data/backup", tokenFile: tokenPath, field: "data.data.key", passphrase: passphrase{value: "secret"}}
+	key, err := source.privateKey()
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, key)
+
+	source.tokenFile = ""
+	_, err = source.privateKey()
+	assert.ErrorContains(t, err, "403")
+}
+
+func TestHTTPKeySourceOverSocket(t *testing.T) {
+	privateKey, pem := testPrivateKey(t, "")
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+
+	// a stand-in for the local agent, which answers with the PEM itself
+	agent := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, pem)
+	}))
+	agent.Listener = listener
+	agent.Start()
+	defer agent.Close()
+
+	key, err := httpKeySource{url: "http://agent/key", socket: socket}.privateKey()
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, key)
+}
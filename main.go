@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,7 +21,7 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := elastic.backupDocuments(sb, conf.publicKeyPath, flags.name); err != nil {
+		if err := elastic.backupDocuments(sb, conf.publicKeyPaths, conf.signingKeyPath, flags.name); err != nil {
 			log.Fatal(err)
 		}
 	case "es_restore":
@@ -32,7 +34,96 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := elastic.restoreDocuments(sb, conf.privateKeyPath, flags.name, conf.c4ghPassword); err != nil {
+		if flags.name == "latest" && flags.index == "" {
+			log.Fatal("es_restore --name latest needs --index to select the index to restore")
+		}
+		name, err := resolveBackupName(sb, flags.name, flags.before, ".bup", conf.elastic.filePrefix+flags.index)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := elastic.restoreDocuments(sb, conf.privateKeys, name); err != nil {
+			log.Fatal(err)
+		}
+	case "es_backup_templates":
+		elastic, err := newElasticClient(conf.elastic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		if err := elastic.backupTemplates(sb, conf.publicKeyPaths, conf.signingKeyPath, flags.name); err != nil {
+			log.Fatal(err)
+		}
+	case "es_restore_templates":
+		elastic, err := newElasticClient(conf.elastic)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		name, err := resolveBackupName(sb, flags.name, flags.before, templatesSuffix, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := elastic.restoreTemplates(sb, conf.privateKeys, name); err != nil {
+			log.Fatal(err)
+		}
+	case "es_snapshot_repository":
+		elastic, err := newElasticClient(conf.elastic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := elastic.registerSnapshotRepository(conf.s3); err != nil {
+			log.Fatal(err)
+		}
+	case "es_snapshot":
+		elastic, err := newElasticClient(conf.elastic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := elastic.createSnapshot(flags.name); err != nil {
+			log.Fatal(err)
+		}
+	case "es_snapshot_list":
+		elastic, err := newElasticClient(conf.elastic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		snapshots, err := elastic.listSnapshots()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := printSnapshots(os.Stdout, snapshots, flags.format); err != nil {
+			log.Fatal(err)
+		}
+	case "es_snapshot_restore":
+		elastic, err := newElasticClient(conf.elastic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := elastic.restoreSnapshot(flags.name, flags.index); err != nil {
+			log.Fatal(err)
+		}
+	case "es_snapshot_delete":
+		elastic, err := newElasticClient(conf.elastic)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := elastic.deleteSnapshot(flags.name); err != nil {
 			log.Fatal(err)
 		}
 	case "mongo_dump":
@@ -42,7 +133,7 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := mongo.dump(*sb, conf.publicKeyPath, flags.name); err != nil {
+		if err := mongo.dump(*sb, conf.publicKeyPaths, conf.signingKeyPath, flags.name); err != nil {
 			log.Fatal(err)
 		}
 	case "mongo_restore":
@@ -52,7 +143,15 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := mongo.restore(*sb, conf.privateKeyPath, flags.name, conf.c4ghPassword); err != nil {
+		if flags.name == "latest" && mongo.database == "" {
+			log.Fatal("mongo_restore --name latest needs mongo.database to select the database to restore")
+		}
+		name, err := resolveBackupName(sb, flags.name, flags.before, ".archive", mongo.database)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := mongo.restore(*sb, conf.privateKeys, name); err != nil {
 			log.Fatal(err)
 		}
 	case "pg_dump":
@@ -62,7 +161,7 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := pg.dump(*sb, conf.publicKeyPath); err != nil {
+		if err := pg.dump(*sb, conf.publicKeyPaths, conf.signingKeyPath); err != nil {
 			log.Fatal(err)
 		}
 	case "pg_restore":
@@ -72,7 +171,12 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := pg.restore(*sb, conf.privateKeyPath, flags.name, conf.c4ghPassword); err != nil {
+		name, err := resolveBackupName(sb, flags.name, flags.before, ".sqldump", pg.database)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := pg.restore(*sb, conf.privateKeys, name); err != nil {
 			log.Fatal(err)
 		}
 	case "pg_basebackup":
@@ -82,7 +186,7 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := pg.basebackup(*sb, conf.publicKeyPath); err != nil {
+		if err := pg.basebackup(*sb, conf.publicKeyPaths, conf.signingKeyPath); err != nil {
 			log.Fatal(err)
 		}
 	case "pg_db-unpack":
@@ -92,7 +196,90 @@ func main() {
 			log.Fatal("Could not connect to s3 backend: ", err)
 		}
 
-		if err := pg.baseBackupUnpack(*sb, conf.privateKeyPath, flags.name, conf.c4ghPassword); err != nil {
+		name, err := resolveBackupName(sb, flags.name, flags.before, ".enc", pg.database)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := pg.baseBackupUnpack(*sb, conf.privateKeys, name); err != nil {
+			log.Fatal(err)
+		}
+	case "list_backups":
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		backups, err := listBackups(sb)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := printBackups(os.Stdout, backups, flags.format); err != nil {
+			log.Fatal(err)
+		}
+	case "prune":
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		if err := pruneBackups(sb, conf.retention, flags.dryRun); err != nil {
+			log.Fatal(err)
+		}
+	case "check_keys":
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		privateKey, err := conf.privateKeys.privateKey()
+		if err != nil {
+			log.Fatalf("could not retrieve private key: %s", err)
+		}
+
+		if err := checkKeys(sb, privateKey, flags.name); err != nil {
+			log.Fatal(err)
+		}
+	case "verify_backup":
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		privateKey, err := conf.privateKeys.privateKey()
+		if err != nil {
+			log.Fatalf("could not retrieve private key: %s", err)
+		}
+
+		if err := verifyBackup(sb, privateKey, flags.name); err != nil {
+			log.Fatal(err)
+		}
+	case "restore_drill":
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		if err := restoreDrill(sb, conf); err != nil {
+			log.Fatal(err)
+		}
+	case "reencrypt":
+		sb, err := newS3Backend(conf.s3)
+		if err != nil {
+			log.Fatal("Could not connect to s3 backend: ", err)
+		}
+
+		privateKey, err := conf.privateKeys.privateKey()
+		if err != nil {
+			log.Fatalf("could not retrieve private key: %s", err)
+		}
+		_, publicKeyList, err := getKeys(conf.publicKeyPaths)
+		if err != nil {
+			log.Fatalf("could not retrieve public keys: %s", err)
+		}
+
+		if err := reencryptBackups(sb, privateKey, publicKeyList, conf.signingKeyPath, flags.name); err != nil {
 			log.Fatal(err)
 		}
 	case "backup_bucket":
@@ -106,7 +293,7 @@ func main() {
 			log.Fatal("Could not connect to s3 destnation backend: ", err)
 		}
 
-		if err = BackupS3BucketEncrypted(src, dst, conf.publicKeyPath); err != nil {
+		if err = BackupS3BucketEncrypted(src, dst, conf.publicKeyPaths, conf.signingKeyPath); err != nil {
 			log.Fatal(err)
 		}
 	case "restore_bucket":
@@ -120,7 +307,7 @@ func main() {
 			log.Fatal("Could not connect to s3 destnation backend: ", err)
 
 		}
-		err = RestoreEncryptedS3Bucket(src, dst, conf.c4ghPassword, conf.privateKeyPath)
+		err = RestoreEncryptedS3Bucket(src, dst, conf.privateKeys)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -135,7 +322,7 @@ func main() {
 			log.Fatal("Could not connect to s3 destnation backend: ", err)
 
 		}
-		err = SyncS3Buckets(src, dst)
+		err = SyncS3Buckets(src, dst, conf.sync)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// manifestSuffix is appended to the name of a backup to get the name of its manifest
+const manifestSuffix = ".manifest.json"
+
+// backupManifest describes a single backup artifact. It is stored next to
+// the artifact so that restores and audits do not have to rely on the name
+// of the backup object.
+type backupManifest struct {
+	Artifact        string             `json:"artifact"`
+	SourceType      string             `json:"source_type"`
+	Source          string             `json:"source"`
+	ToolVersions    map[string]string  `json:"tool_versions,omitempty"`
+	Started         time.Time          `json:"started"`
+	Finished        time.Time          `json:"finished"`
+	PlaintextBytes  int64              `json:"plaintext_bytes"`
+	CompressedBytes int64              `json:"compressed_bytes"`
+	PlaintextSHA256 string             `json:"plaintext_sha256"`
+	Recipients      []string           `json:"recipients"`
+	Signature       *manifestSignature `json:"signature,omitempty"`
+}
+
+// manifestSignature is an ed25519 signature over the manifest serialized
+// without the signature field.
+type manifestSignature struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// newBackupManifest starts a manifest for an artifact, the start time is set to now
+func newBackupManifest(artifact, sourceType, source string) *backupManifest {
+	return &backupManifest{
+		Artifact:     artifact,
+		SourceType:   sourceType,
+		Source:       source,
+		ToolVersions: make(map[string]string),
+		Started:      time.Now().UTC(),
+	}
+}
+
+// finish records the end time and the byte counts of the backup
+func (m *backupManifest) finish(plaintext, compressed *measuredWriter) {
+	m.Finished = time.Now().UTC()
+	m.PlaintextBytes = plaintext.n
+	m.PlaintextSHA256 = plaintext.sum()
+	m.CompressedBytes = compressed.n
+}
+
+// keyFingerprint returns the hex encoded sha256 sum of a crypt4gh key
+func keyFingerprint(key [32]byte) string {
+	sum := sha256.Sum256(key[:])
+
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// keyFingerprints returns the fingerprints of a list of crypt4gh keys
+func keyFingerprints(keys [][32]byte) []string {
+	fingerprints := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fingerprints = append(fingerprints, keyFingerprint(key))
+	}
+
+	return fingerprints
+}
+
+// toolVersion returns the first line of the output of `<tool> --version`
+func toolVersion(tool string) string {
+	out, err := exec.Command(tool, "--version").Output()
+	if err != nil {
+		log.Debugf("Could not get version of %s: %v", tool, err)
+
+		return "unknown"
+	}
+
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
+
+// measuredWriter counts, and optionally hashes, the bytes written through it
+type measuredWriter struct {
+	w io.Writer
+	n int64
+	h hash.Hash
+}
+
+func newMeasuredWriter(w io.Writer, checksum bool) *measuredWriter {
+	mw := &measuredWriter{w: w}
+	if checksum {
+		mw.h = sha256.New()
+	}
+
+	return mw
+}
+
+func (mw *measuredWriter) Write(p []byte) (int, error) {
+	n, err := mw.w.Write(p)
+	mw.n += int64(n)
+	if mw.h != nil {
+		mw.h.Write(p[:n])
+	}
+
+	return n, err
+}
+
+func (mw *measuredWriter) sum() string {
+	if mw.h == nil {
+		return ""
+	}
+
+	return hex.EncodeToString(mw.h.Sum(nil))
+}
+
+// readSigningKey reads an ed25519 private key in PKCS8 PEM format
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is not an ed25519 key")
+	}
+
+	return signingKey, nil
+}
+
+// signingPayload is the serialized manifest without its signature
+func (m *backupManifest) signingPayload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+
+	return json.Marshal(unsigned)
+}
+
+// sign adds an ed25519 signature to the manifest
+func (m *backupManifest) sign(key ed25519.PrivateKey) error {
+	payload, err := m.signingPayload()
+	if err != nil {
+		return err
+	}
+	m.Signature = signPayload(key, payload)
+
+	return nil
+}
+
+// verify checks the signature of the manifest against a public key
+func (m *backupManifest) verify(key ed25519.PublicKey) error {
+	payload, err := m.signingPayload()
+	if err != nil {
+		return err
+	}
+
+	return verifyPayload(key, payload, m.Signature)
+}
+
+func signPayload(key ed25519.PrivateKey, payload []byte) *manifestSignature {
+	pub, _ := key.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(pub)
+
+	return &manifestSignature{
+		KeyID:     "SHA256:" + hex.EncodeToString(sum[:]),
+		Algorithm: "ed25519",
+		Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	}
+}
+
+func verifyPayload(key ed25519.PublicKey, payload []byte, signature *manifestSignature) error {
+	if signature == nil {
+		return fmt.Errorf("manifest is not signed")
+	}
+
+	value, err := base64.StdEncoding.DecodeString(signature.Value)
+	if err != nil {
+		return fmt.Errorf("could not decode signature: %s", err)
+	}
+
+	if !ed25519.Verify(key, payload, value) {
+		return fmt.Errorf("manifest signature does not match")
+	}
+
+	return nil
+}
+
+// writeManifest signs the manifest, if a signing key is configured, and
+// stores it next to the artifact it describes.
+func (sb *s3Backend) writeManifest(m *backupManifest, signingKeyPath string) error {
+	if signingKeyPath != "" {
+		key, err := readSigningKey(signingKeyPath)
+		if err != nil {
+			return fmt.Errorf("could not read manifest signing key: %s", err)
+		}
+		if err := m.sign(key); err != nil {
+			return fmt.Errorf("could not sign manifest: %s", err)
+		}
+	} else {
+		log.Warnf("No manifest signing key configured, manifest for %s is unsigned", m.Artifact)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = sb.Uploader.Upload(&s3manager.UploadInput{
+		Body:        bytes.NewReader(data),
+		Bucket:      aws.String(sb.Bucket),
+		Key:         aws.String(m.Artifact + manifestSuffix),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("could not upload manifest: %s", err)
+	}
+
+	log.Debugf("Manifest %s%s written", m.Artifact, manifestSuffix)
+
+	return nil
+}
+
+// readManifest fetches the manifest of an artifact from the bucket
+func (sb *s3Backend) readManifest(artifact string) (*backupManifest, error) {
+	r, err := sb.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(artifact + manifestSuffix),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	m := &backupManifest{}
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest: %s", err)
+	}
+
+	return m, nil
+}
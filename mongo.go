@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os/exec"
 	"sync"
 	"time"
@@ -22,32 +23,43 @@ type mongoConfig struct {
 	caCert     string
 	tls        bool
 	clientCert string
+	// restoreDatabase renames the database of an archive when it is
+	// restored, the archive is restored as it was dumped when it is empty
+	restoreDatabase string
 }
 
-func (mongo mongoConfig) dump(sb s3Backend, publicKeyPath, database string) error {
+// dump streams the mongodump archive through the compressor and the
+// encryptor straight into the backup bucket. If mongodump fails the upload
+// is aborted so that no truncated archive is stored.
+func (mongo mongoConfig) dump(sb s3Backend, publicKeyPaths []string, signingKeyPath, database string) error {
 	log.Info("Mongo dump started")
 	today := time.Now().Format("20060102150405")
+	manifest := newBackupManifest(today+"-"+database+".archive", "mongodb", database)
+	manifest.ToolVersions["mongodump"] = toolVersion("mongodump")
 	mongo.database = database
+
+	privateKey, publicKeyList, err := getKeys(publicKeyPaths)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve public key or generate private key: %s", err)
+	}
+
+	log.Debug("Public key retrieved and private key successfully created")
+
 	dumpCommand := buildDumpCommand(mongo)
 	log.Debugln(dumpCommand)
 
 	cmd := exec.Command("sh", "-c", dumpCommand)
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-
 	var errMsg bytes.Buffer
 	cmd.Stderr = &errMsg
 
-	err := cmd.Run()
+	out, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return fmt.Errorf("Could not open mongodump output: %s", err)
 	}
 
-	log.Debug("Mongo dump command successfully executed")
-
 	wg := sync.WaitGroup{}
-	mongoArchive := today + "-" + database + ".archive"
+	mongoArchive := manifest.Artifact
 	wr, err := sb.NewFileWriter(mongoArchive, &wg)
 	if err != nil {
 		return fmt.Errorf("Could not open backup file for writing: %s", err)
@@ -55,114 +67,152 @@ func (mongo mongoConfig) dump(sb s3Backend, publicKeyPath, database string) erro
 
 	log.Debugf("Mongo archive file %v ready for writing", mongoArchive)
 
-	privateKey, publicKeyList, err := getKeys(publicKeyPath)
-	if err != nil {
-		return fmt.Errorf("Could not retrieve public key or generate private key: %s", err)
-	}
-
-	log.Debug("Public key retrieved and private key successfully created")
-
 	e, err := newEncryptor(publicKeyList, privateKey, wr)
 	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
 		return fmt.Errorf("Could not initialize encryptor: %s", err)
 	}
 
 	log.Debug("Encryption initialized")
 
-	c, err := newCompressor(e)
+	compressed := newMeasuredWriter(e, false)
+	c, err := newCompressor(compressed)
 	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
 		return fmt.Errorf("Could not initialize compressor: %s", err)
 	}
 
 	log.Debug("Compression initialized")
 
-	_, err = c.Write(out.Bytes())
-	if err != nil {
-		log.Errorf("Could not encrypt/write: %s", err)
+	if err := cmd.Start(); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not start mongodump: %s", err)
+	}
+
+	plaintext := newMeasuredWriter(c, true)
+	if _, err := io.Copy(plaintext, out); err != nil {
+		// mongodump would block on a full pipe if it is left running
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not encrypt/write: %s", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("mongodump failed: %s: %s", err, errMsg.String())
 	}
 
+	log.Debug("Mongo dump command successfully executed")
+
 	if err := c.Close(); err != nil {
-		log.Errorf("Could not close compressor: %v", err)
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not close compressor: %s", err)
 	}
 
 	if err := e.Close(); err != nil {
-		log.Errorf("Could not close encryptor: %v", err)
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not close encryptor: %s", err)
 	}
 
 	if err := wr.Close(); err != nil {
-		log.Errorf("Could not close destination file: %v", err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not upload mongo archive: %s", err)
 	}
 	wg.Wait()
 
 	log.Info("Mongo archive is compressed and encrypted")
 
-	return nil
+	manifest.Recipients = keyFingerprints(publicKeyList)
+	manifest.finish(plaintext, compressed)
+
+	return sb.writeManifest(manifest, signingKeyPath)
+}
+
+// restore streams an archive from the backup bucket through the decryptor
+// and the decompressor into mongorestore.
+func (mongo mongoConfig) restore(sb s3Backend, privateKeys keySource, archive string) error {
+	_, err := mongo.restoreArchive(sb, privateKeys, archive)
+
+	return err
 }
 
-func (mongo mongoConfig) restore(sb s3Backend, privateKeyPath, archive, c4ghPassword string) error {
+// restoreArchive restores an archive and returns the log of mongorestore
+func (mongo mongoConfig) restoreArchive(sb s3Backend, privateKeys keySource, archive string) (string, error) {
 	log.Info("Start restoration from mongo archive")
-	fr, err := sb.NewFileReader(archive)
+	privateKey, err := privateKeys.privateKey()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("Could not retrieve private key: %s", err)
 	}
-	defer fr.Close()
 
-	log.Debug("Read mongo file")
+	log.Debug("Private key retrieved")
 
-	privateKey, err := getPrivateKey(privateKeyPath, c4ghPassword)
+	if _, err := sb.checkKey(archive, privateKey); err != nil {
+		return "", err
+	}
+
+	fr, err := sb.NewFileReader(archive)
 	if err != nil {
-		return fmt.Errorf("Could not retrieve private key: %s", err)
+		return "", err
 	}
+	defer fr.Close()
 
-	log.Debug("Private key retrieved")
+	log.Debug("Read mongo file")
 
 	r, err := newDecryptor(privateKey, fr)
 	if err != nil {
-		return fmt.Errorf("Could not initialise decryptor: %s", err)
+		return "", fmt.Errorf("Could not initialise decryptor: %s", err)
 	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Errorf("Could not close decryptor: %v", err)
+		}
+	}()
 
 	log.Debug("Decryption initialized")
 
 	d, err := newDecompressor(r)
 	if err != nil {
-		return fmt.Errorf("Could not initialise decompressor: %s", err)
+		return "", fmt.Errorf("Could not initialise decompressor: %s", err)
 	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			log.Errorf("Could not close decompressor: %v", err)
+		}
+	}()
 
 	log.Debug("Decompression initialized")
 
 	restoreCommand := buildRestoreCommand(mongo)
 	log.Debugln(restoreCommand)
 	cmd := exec.Command("sh", "-c", restoreCommand)
-
-	var in bytes.Buffer
-	cmd.Stdin = &in
-
-	_, err = in.ReadFrom(d)
-	if err != nil {
-		return fmt.Errorf("Could not read datastream: %s", err)
-	}
-
-	if err := d.Close(); err != nil {
-		log.Errorf("Could not close decompressor: %v", err)
-	}
-
-	if err := r.Close(); err != nil {
-		log.Errorf("Could not close decryptor: %v", err)
-	}
-
-	log.Debug("Data read successfully")
+	cmd.Stdin = d
 
 	var errMsg bytes.Buffer
 	cmd.Stderr = &errMsg
 
 	err = cmd.Run()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("mongorestore failed: %s: %s", err, errMsg.String())
 	}
 
 	log.Debug("Importing mongo data finished")
 
-	return nil
+	return errMsg.String(), nil
 }
 
 func buildRestoreCommand(mongo mongoConfig) string {
@@ -176,11 +226,31 @@ func buildRestoreCommand(mongo mongoConfig) string {
 	if mongo.tls {
 		cmd += fmt.Sprintf(" --ssl --sslCAFile=%s --sslPEMKeyFile=%s", mongo.caCert, mongo.clientCert)
 	}
+	if mongo.restoreDatabase != "" {
+		cmd += fmt.Sprintf(" --nsFrom='%s.*' --nsTo='%s.*'", mongo.database, mongo.restoreDatabase)
+	}
 	cmd += " --archive"
 
 	return cmd
 }
 
+// buildDropCommand builds a mongosh command that drops the restoreDatabase
+func buildDropCommand(mongo mongoConfig) string {
+	cmd := fmt.Sprintf("mongosh --quiet 'mongodb://%s:%s@%s/%s?authSource=admin", mongo.user, mongo.password, mongo.host, mongo.restoreDatabase)
+
+	if mongo.replicaSet != "" {
+		cmd += fmt.Sprintf("&replicaSet=%s'", mongo.replicaSet)
+	} else {
+		cmd += "'"
+	}
+	if mongo.tls {
+		cmd += fmt.Sprintf(" --tls --tlsCAFile=%s --tlsCertificateKeyFile=%s", mongo.caCert, mongo.clientCert)
+	}
+	cmd += " --eval 'db.dropDatabase()'"
+
+	return cmd
+}
+
 func buildDumpCommand(mongo mongoConfig) string {
 	cmd := fmt.Sprintf("mongodump --uri='mongodb://%s:%s@%s/%s?authSource=admin", mongo.user, mongo.password, mongo.host, mongo.database)
 
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,9 +34,11 @@ type DBConf struct {
 // - compresses the encrypted file
 // - gets the key and encrypts the tar file
 // - puts the encrypted and compressed file in S3
-func (db DBConf) basebackup(sb s3Backend, publicKeyPath string) error {
+func (db DBConf) basebackup(sb s3Backend, publicKeyPaths []string, signingKeyPath string) error {
 	log.Info("Basebackup started")
 	today := time.Now().Format("20060102150405")
+	manifest := newBackupManifest(today+"-"+db.database+".enc", "postgres-basebackup", db.database)
+	manifest.ToolVersions["pg_basebackup"] = toolVersion("pg_basebackup")
 	destDir := "db-backup"
 	dbURI := buildConnInfo(db)
 	cmd := exec.Command("pg_basebackup", dbURI, "-F", "p", "-D", destDir)
@@ -72,31 +75,38 @@ func (db DBConf) basebackup(sb s3Backend, publicKeyPath string) error {
 
 	log.Debugf("%v.tar file created", destDir)
 
-	fileName := today + "-" + db.database + ".enc"
-	wg := sync.WaitGroup{}
-	wr, err := sb.NewFileWriter(fileName, &wg)
+	privateKey, publicKeyList, err := getKeys(publicKeyPaths)
 	if err != nil {
-		return fmt.Errorf("Could not open backup file for writing: %s", err)
+		return fmt.Errorf("Could not retrieve public key or generate private key: %s", err)
 	}
 
-	log.Debugf("Backup file %v ready for writing", fileName)
+	log.Debug("Public key retrieved and private key successfully created")
 
-	privateKey, publicKeyList, err := getKeys(publicKeyPath)
+	fileName := manifest.Artifact
+	wg := sync.WaitGroup{}
+	wr, err := sb.NewFileWriter(fileName, &wg)
 	if err != nil {
-		return fmt.Errorf("Could not retrieve public key or generate private key: %s", err)
+		return fmt.Errorf("Could not open backup file for writing: %s", err)
 	}
 
-	log.Debug("Public key retrieved and private key successfully created")
+	log.Debugf("Backup file %v ready for writing", fileName)
 
 	e, err := newEncryptor(publicKeyList, privateKey, wr)
 	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
 		return fmt.Errorf("Could not initialize encryptor: %s", err)
 	}
 
 	log.Debug("Encryption initialized")
 
-	c, err := newCompressor(e)
+	compressed := newMeasuredWriter(e, false)
+	c, err := newCompressor(compressed)
 	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
 		return fmt.Errorf("Could not initialize compressor: %s", err)
 	}
 
@@ -105,54 +115,77 @@ func (db DBConf) basebackup(sb s3Backend, publicKeyPath string) error {
 	sourceFileName := destDir + ".tar"
 	data, err := os.ReadFile(sourceFileName)
 	if err != nil {
-		log.Errorf("Error in reading source data: %v", err)
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Error in reading source data: %s", err)
 	}
-	_, err = c.Write(data)
-	if err != nil {
-		log.Errorf("Error in writer: %v", err)
+	plaintext := newMeasuredWriter(c, true)
+	if _, err := plaintext.Write(data); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Error in writer: %s", err)
 	}
 
-	err = c.Close()
-	if err != nil {
-		log.Errorf("Could not close compressor: %v", err)
+	if err := c.Close(); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not close compressor: %s", err)
 	}
 
 	if err := e.Close(); err != nil {
-		log.Errorf("Could not close encryptor: %v", err)
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not close encryptor: %s", err)
 	}
 
-	err = wr.Close()
-	if err != nil {
-		log.Errorf("Could not close destination file: %v", err)
+	if err := wr.Close(); err != nil {
+		wg.Wait()
+
+		return fmt.Errorf("Could not upload backup file: %s", err)
 	}
 	wg.Wait()
 
 	log.Info("Backup data are compressed and encrypted")
 
-	return nil
+	manifest.Recipients = keyFingerprints(publicKeyList)
+	manifest.finish(plaintext, compressed)
+
+	return sb.writeManifest(manifest, signingKeyPath)
 }
 
-func (db DBConf) dump(sb s3Backend, publicKeyPath string) error {
+// dump streams the output of pg_dump through the compressor and the
+// encryptor straight into the backup bucket. If pg_dump fails the upload is
+// aborted so that no truncated dump is stored.
+func (db DBConf) dump(sb s3Backend, publicKeyPaths []string, signingKeyPath string) error {
 	log.Info("Dump backup started")
 	today := time.Now().Format("20060102150405")
+	manifest := newBackupManifest(today+"-"+db.database+".sqldump", "postgres", db.database)
+	manifest.ToolVersions["pg_dump"] = toolVersion("pg_dump")
+
+	privateKey, publicKeyList, err := getKeys(publicKeyPaths)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve public key or generate private key: %s", err)
+	}
+
+	log.Debug("Public key retrieved and private key successfully created")
+
 	dbURI := buildConnInfo(db)
 	cmd := exec.Command("pg_dump", dbURI, "-xF", "tar")
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-
 	var errMsg bytes.Buffer
 	cmd.Stderr = &errMsg
 
-	err := cmd.Run()
+	out, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return fmt.Errorf("Could not open pg_dump output: %s", err)
 	}
 
-	log.Debug("Dump command successfully executed")
-
 	wg := sync.WaitGroup{}
-	dumpFile := today + "-" + db.database + ".sqldump"
+	dumpFile := manifest.Artifact
 	wr, err := sb.NewFileWriter(dumpFile, &wg)
 	if err != nil {
 		return fmt.Errorf("Could not open backup file for writing: %s", err)
@@ -160,48 +193,80 @@ func (db DBConf) dump(sb s3Backend, publicKeyPath string) error {
 
 	log.Debugf("Dump file %v ready for writing", dumpFile)
 
-	privateKey, publicKeyList, err := getKeys(publicKeyPath)
-	if err != nil {
-		return fmt.Errorf("Could not retrieve public key or generate private key: %s", err)
-	}
-
-	log.Debug("Public key retrieved and private key successfully created")
-
 	e, err := newEncryptor(publicKeyList, privateKey, wr)
 	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
 		return fmt.Errorf("Could not initialize encryptor: %s", err)
 	}
 
 	log.Debug("Encryption initialized")
 
-	c, err := newCompressor(e)
+	compressed := newMeasuredWriter(e, false)
+	c, err := newCompressor(compressed)
 	if err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
 		return fmt.Errorf("Could not initialize compressor: %s", err)
 	}
 
 	log.Debug("Compression initialized")
 
-	_, err = c.Write(out.Bytes())
-	if err != nil {
+	if err := cmd.Start(); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not start pg_dump: %s", err)
+	}
+
+	plaintext := newMeasuredWriter(c, true)
+	if _, err := io.Copy(plaintext, out); err != nil {
+		// pg_dump would block on a full pipe if it is left running
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		abortWriter(wr, err)
+		wg.Wait()
+
 		return fmt.Errorf("Could not encrypt/write: %s", err)
 	}
+	if err := cmd.Wait(); err != nil {
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("pg_dump failed: %s: %s", err, errMsg.String())
+	}
+
+	log.Debug("Dump command successfully executed")
 
 	if err := c.Close(); err != nil {
-		log.Errorf("Could not close compressor: %v", err)
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not close compressor: %s", err)
 	}
 
 	if err := e.Close(); err != nil {
-		log.Errorf("Could not close encryptor: %v", err)
+		abortWriter(wr, err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not close encryptor: %s", err)
 	}
 
 	if err := wr.Close(); err != nil {
-		log.Errorf("Could not close destination file: %v", err)
+		wg.Wait()
+
+		return fmt.Errorf("Could not upload dump file: %s", err)
 	}
 	wg.Wait()
 
 	log.Info("Dump data are compressed and encrypted")
 
-	return nil
+	manifest.Recipients = keyFingerprints(publicKeyList)
+	manifest.finish(plaintext, compressed)
+
+	return sb.writeManifest(manifest, signingKeyPath)
 }
 
 // BasebackupUnpack function:
@@ -209,8 +274,19 @@ func (db DBConf) dump(sb s3Backend, publicKeyPath string) error {
 // - decrypts and decompress the data
 // - untar the data
 // - puts the db copy in the running container
-func (db DBConf) baseBackupUnpack(sb s3Backend, privateKeyPath, backupTar, c4ghPassword string) error {
+func (db DBConf) baseBackupUnpack(sb s3Backend, privateKeys keySource, backupTar string) error {
 	log.Info("Unpacking basebackup data started")
+	privateKey, err := privateKeys.privateKey()
+	if err != nil {
+		return fmt.Errorf("Could not retrieve private key: %s", err)
+	}
+
+	log.Debug("Private key retrieved")
+
+	if _, err := sb.checkKey(backupTar, privateKey); err != nil {
+		return err
+	}
+
 	localTar, err := os.Create("/home/backup.tar")
 	if err != nil {
 		log.Errorf("Error in creating file: %v", err)
@@ -226,13 +302,6 @@ func (db DBConf) baseBackupUnpack(sb s3Backend, privateKeyPath, backupTar, c4ghP
 
 	log.Debug("Data ready for unpacking")
 
-	privateKey, err := getPrivateKey(privateKeyPath, c4ghPassword)
-	if err != nil {
-		return fmt.Errorf("Could not retrieve private key: %s", err)
-	}
-
-	log.Debug("Private key retrieved")
-
 	r, err := newDecryptor(privateKey, fr)
 	if err != nil {
 		return fmt.Errorf("Could not initialise decryptor: %s", err)
@@ -279,27 +348,38 @@ func (db DBConf) baseBackupUnpack(sb s3Backend, privateKeyPath, backupTar, c4ghP
 	return nil
 }
 
-func (db DBConf) restore(sb s3Backend, privateKeyPath, sqlDump, c4ghPassword string) error {
+// restore streams a dump from the backup bucket through the decryptor and
+// the decompressor into pg_restore.
+func (db DBConf) restore(sb s3Backend, privateKeys keySource, sqlDump string) error {
 	log.Info("Start importing dump file")
-	fr, err := sb.NewFileReader(sqlDump)
+	privateKey, err := privateKeys.privateKey()
 	if err != nil {
-		return err
+		return fmt.Errorf("Could not retrieve private key: %s", err)
 	}
-	defer fr.Close()
 
-	log.Debug("Read dump file")
+	log.Debug("Private key retrieved")
 
-	privateKey, err := getPrivateKey(privateKeyPath, c4ghPassword)
+	if _, err := sb.checkKey(sqlDump, privateKey); err != nil {
+		return err
+	}
+
+	fr, err := sb.NewFileReader(sqlDump)
 	if err != nil {
-		return fmt.Errorf("Could not retrieve private key: %s", err)
+		return err
 	}
+	defer fr.Close()
 
-	log.Debug("Private key retrieved")
+	log.Debug("Read dump file")
 
 	r, err := newDecryptor(privateKey, fr)
 	if err != nil {
 		return fmt.Errorf("Could not initialise decryptor: %s", err)
 	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Errorf("Could not close decryptor: %v", err)
+		}
+	}()
 
 	log.Debug("Decryption initialized")
 
@@ -307,37 +387,24 @@ func (db DBConf) restore(sb s3Backend, privateKeyPath, sqlDump, c4ghPassword str
 	if err != nil {
 		return fmt.Errorf("Could not initialise decompressor: %s", err)
 	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			log.Errorf("Could not close decompressor: %v", err)
+		}
+	}()
 
 	log.Debug("Decompression initialized")
 
-	data, err := io.ReadAll(d)
-	if err != nil {
-		return fmt.Errorf("Could not read all data: %s", err)
-	}
-
-	if err := d.Close(); err != nil {
-		log.Errorf("Could not close decompressor: %v", err)
-	}
-
-	if err := r.Close(); err != nil {
-		log.Errorf("Could not close decryptor: %v", err)
-	}
-
-	log.Debug("Data read successfully")
-
 	dbURI := fmt.Sprintf("--dbname=postgresql://%s:%s@%s:%d/%s", db.user, db.password, db.host, db.port, db.database)
 	cmd := exec.Command("pg_restore", dbURI)
-
-	var in bytes.Buffer
-	cmd.Stdin = &in
-	in.Write(data)
+	cmd.Stdin = d
 
 	var errMsg bytes.Buffer
 	cmd.Stderr = &errMsg
 
 	err = cmd.Run()
 	if err != nil {
-		return err
+		return fmt.Errorf("pg_restore failed: %s: %s", err, errMsg.String())
 	}
 
 	log.Debug("Importing dump data finished")
@@ -345,6 +412,22 @@ func (db DBConf) restore(sb s3Backend, privateKeyPath, sqlDump, c4ghPassword str
 	return nil
 }
 
+// psql runs an SQL statement against the database and returns its output
+// unaligned and without headers
+func (db DBConf) psql(statement string) (string, error) {
+	cmd := exec.Command("psql", buildConnInfo(db), "--no-psqlrc", "-At", "-c", statement)
+
+	var errMsg bytes.Buffer
+	cmd.Stderr = &errMsg
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("psql failed: %s: %s", err, errMsg.String())
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
 // buildConnInfo builds a connection string for the database
 func buildConnInfo(db DBConf) string {
 	dbURI := fmt.Sprintf("--dbname=postgresql://%s:%s@%s:%d/%s", db.user, db.password, db.host, db.port, db.database)
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/neicnordic/crypt4gh/model/headers"
+	log "github.com/sirupsen/logrus"
+)
+
+// reencryptPartSize is the size of the first part of a re-encrypted object,
+// the smallest part S3 accepts in a multipart upload. Only this part is
+// uploaded, the rest of the encrypted data is copied within S3.
+const reencryptPartSize = 5 * 1024 * 1024
+
+// maxCopyPartSize is the largest range S3 copies in a single part
+const maxCopyPartSize = 5 * 1024 * 1024 * 1024
+
+// isEncryptedBackup reports if an object is a crypt4gh encrypted backup
+func isEncryptedBackup(key string) bool {
+	if _, ok := parseBackupName(key, time.Time{}); ok {
+		return true
+	}
+
+	return strings.Contains(key, ".bup.part-")
+}
+
+// reencryptBackups rewrites the crypt4gh headers of backups for a new list
+// of recipients. The data of the backups is neither decrypted nor changed,
+// so this only needs a private key that can read the current headers. With
+// an empty name every backup under the PathPrefix is re-encrypted, and the
+// recipients of their manifests are updated.
+func reencryptBackups(sb *s3Backend, privateKey [32]byte, publicKeyList [][32]byte, signingKeyPath, name string) error {
+	if name != "" {
+		return sb.reencryptObject(name, privateKey, publicKeyList, signingKeyPath)
+	}
+
+	var (
+		mu              sync.Mutex
+		bucketManifests []string
+	)
+	err := transferObjects(sb, "reencrypt", func(obj *s3.Object) (bool, error) {
+		if path.Base(*obj.Key) == bucketManifestName {
+			mu.Lock()
+			bucketManifests = append(bucketManifests, *obj.Key)
+			mu.Unlock()
+
+			return false, nil
+		}
+		if !isEncryptedBackup(*obj.Key) {
+			return false, nil
+		}
+
+		return true, sb.reencryptObject(*obj.Key, privateKey, publicKeyList, signingKeyPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range bucketManifests {
+		if err := sb.updateBucketManifestRecipients(key, publicKeyList, signingKeyPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reencryptObject replaces the crypt4gh header of an object with one for the
+// new recipients. Small objects are uploaded again as a whole, larger ones
+// are rewritten with a multipart upload where only the first part is
+// uploaded and the rest is copied from the old object within S3.
+func (sb *s3Backend) reencryptObject(key string, privateKey [32]byte, publicKeyList [][32]byte, signingKeyPath string) error {
+	obj, err := sb.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	oldHeader, err := headers.ReadHeader(obj.Body)
+	if err != nil {
+		return fmt.Errorf("could not read crypt4gh header: %s", err)
+	}
+	newHeader, err := headers.ReEncryptHeader(oldHeader, privateKey, publicKeyList)
+	if err != nil {
+		return fmt.Errorf("could not re-encrypt crypt4gh header: %s", err)
+	}
+
+	dataSize := aws.Int64Value(obj.ContentLength) - int64(len(oldHeader))
+	head := int64(reencryptPartSize - len(newHeader))
+	if dataSize <= head {
+		_, err = sb.Uploader.Upload(&s3manager.UploadInput{
+			Body:   io.MultiReader(bytes.NewReader(newHeader), obj.Body),
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return fmt.Errorf("could not upload re-encrypted object: %s", err)
+		}
+	} else {
+		first := make([]byte, head)
+		if _, err := io.ReadFull(obj.Body, first); err != nil {
+			return fmt.Errorf("could not read object: %s", err)
+		}
+		part := append(newHeader, first...)
+		offset := int64(len(oldHeader)) + head
+		if err := sb.rewriteObject(key, aws.StringValue(obj.ETag), part, offset, aws.Int64Value(obj.ContentLength)); err != nil {
+			return err
+		}
+	}
+	log.Debugf("Re-encrypted %s", key)
+
+	return sb.updateManifestRecipients(key, publicKeyList, signingKeyPath)
+}
+
+// rewriteObject replaces an object with the first part followed by the bytes
+// of the current object from offset to size, copied within S3. The copy only
+// succeeds if the object still has the given ETag.
+func (sb *s3Backend) rewriteObject(key, etag string, first []byte, offset, size int64) error {
+	upload, err := sb.Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("could not start multipart upload: %s", err)
+	}
+
+	abort := func(err error) error {
+		_, aerr := sb.Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(sb.Bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		if aerr != nil {
+			log.Warnf("Could not abort multipart upload of %s: %v", key, aerr)
+		}
+
+		return err
+	}
+
+	res, err := sb.Client.UploadPart(&s3.UploadPartInput{
+		Body:       bytes.NewReader(first),
+		Bucket:     aws.String(sb.Bucket),
+		Key:        aws.String(key),
+		PartNumber: aws.Int64(1),
+		UploadId:   upload.UploadId,
+	})
+	if err != nil {
+		return abort(fmt.Errorf("could not upload header part: %s", err))
+	}
+	parts := []*s3.CompletedPart{{ETag: res.ETag, PartNumber: aws.Int64(1)}}
+
+	source := url.PathEscape(sb.Bucket + "/" + key)
+	for start := offset; start < size; start += maxCopyPartSize {
+		end := start + maxCopyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		number := aws.Int64(int64(len(parts) + 1))
+		copied, err := sb.Client.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:            aws.String(sb.Bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(source),
+			CopySourceIfMatch: aws.String(etag),
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:        number,
+			UploadId:          upload.UploadId,
+		})
+		if err != nil {
+			return abort(fmt.Errorf("could not copy data part: %s", err))
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: number})
+	}
+
+	_, err = sb.Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(sb.Bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(fmt.Errorf("could not complete multipart upload: %s", err))
+	}
+
+	return nil
+}
+
+// updateManifestRecipients records the new recipients in the manifest of a
+// backup, backups without a manifest are left as they are
+func (sb *s3Backend) updateManifestRecipients(key string, publicKeyList [][32]byte, signingKeyPath string) error {
+	if !sb.objectExists(key + manifestSuffix) {
+		return nil
+	}
+
+	manifest, err := sb.readManifest(key)
+	if err != nil {
+		return fmt.Errorf("could not read manifest of %s: %s", key, err)
+	}
+	manifest.Recipients = keyFingerprints(publicKeyList)
+	manifest.Signature = nil
+
+	return sb.writeManifest(manifest, signingKeyPath)
+}
+
+// updateBucketManifestRecipients records the new recipients in a bucket
+// backup manifest
+func (sb *s3Backend) updateBucketManifestRecipients(key string, publicKeyList [][32]byte, signingKeyPath string) error {
+	r, err := sb.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	manifest := &bucketManifest{}
+	if err := json.NewDecoder(r.Body).Decode(manifest); err != nil {
+		return fmt.Errorf("could not parse backup manifest %s: %s", key, err)
+	}
+	// every object of the bucket backup has been re-encrypted
+	manifest.Recipients = keyFingerprints(publicKeyList)
+	for source, entry := range manifest.Objects {
+		entry.Recipients = manifest.Recipients
+		manifest.Objects[source] = entry
+	}
+
+	return sb.writeBucketManifest(manifest, signingKeyPath)
+}
+
+// objectExists reports if an object exists in the bucket
+func (sb *s3Backend) objectExists(key string) bool {
+	_, err := sb.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(key),
+	})
+
+	return err == nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// retentionPolicy is a grandfather-father-son policy, it keeps the newest
+// backup of each of the last `daily` days, `weekly` weeks and `monthly` months.
+type retentionPolicy struct {
+	daily   int
+	weekly  int
+	monthly int
+}
+
+// retentionConfig holds the retention policies, keyed either by the kind of
+// backup or by `<kind>/<source>` for policies of a single database or index.
+type retentionConfig map[string]retentionPolicy
+
+// policyFor returns the policy for a source, falling back to the policy of
+// the kind. The last return value is false if no policy is configured.
+func (rc retentionConfig) policyFor(kind, source string) (retentionPolicy, bool) {
+	if p, ok := rc[kind+"/"+strings.ToLower(source)]; ok {
+		return p, true
+	}
+	p, ok := rc[kind]
+
+	return p, ok
+}
+
+// pruneDecision records if a backup is kept and why
+type pruneDecision struct {
+	backup backupEntry
+	keep   bool
+	reason string
+}
+
+// applyRetention decides which of the backups of a single kind and source
+// are kept. The newest backup, and the newest one that has a manifest, are
+// always kept so that pruning never removes the last good backup.
+func applyRetention(backups []backupEntry, policy retentionPolicy) []pruneDecision {
+	sorted := append([]backupEntry(nil), backups...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.After(sorted[j].Timestamp)
+	})
+
+	decisions := make([]pruneDecision, len(sorted))
+	for i, b := range sorted {
+		decisions[i] = pruneDecision{backup: b}
+	}
+
+	keep := func(period string, limit int, key func(b backupEntry) string) {
+		seen := make(map[string]bool)
+		for i := range decisions {
+			k := key(decisions[i].backup)
+			if seen[k] {
+				continue
+			}
+			if len(seen) == limit {
+				return
+			}
+			seen[k] = true
+			if !decisions[i].keep {
+				decisions[i].keep = true
+				decisions[i].reason = period
+			}
+		}
+	}
+
+	keep("daily", policy.daily, func(b backupEntry) string {
+		return b.Timestamp.Format("2006-01-02")
+	})
+	keep("weekly", policy.weekly, func(b backupEntry) string {
+		y, w := b.Timestamp.ISOWeek()
+
+		return fmt.Sprintf("%d-%02d", y, w)
+	})
+	keep("monthly", policy.monthly, func(b backupEntry) string {
+		return b.Timestamp.Format("2006-01")
+	})
+
+	for i := range decisions {
+		if decisions[i].backup.Manifest {
+			if !decisions[i].keep {
+				decisions[i].keep = true
+				decisions[i].reason = "last good backup"
+			}
+
+			break
+		}
+	}
+	if len(decisions) > 0 && !decisions[0].keep {
+		decisions[0].keep = true
+		decisions[0].reason = "newest backup"
+	}
+
+	for i := range decisions {
+		if !decisions[i].keep {
+			decisions[i].reason = "expired"
+		}
+	}
+
+	return decisions
+}
+
+// pruneBackups removes the backups that fall outside of the retention
+// policies. Kinds and sources without a policy are left untouched, as are
+// bucket backups which are incremental. With dryRun set the decisions are
+// only logged.
+func pruneBackups(sb *s3Backend, policies retentionConfig, dryRun bool) error {
+	backups, err := listBackups(sb)
+	if err != nil {
+		return fmt.Errorf("could not list backups: %s", err)
+	}
+
+	groups := make(map[string][]backupEntry)
+	var order []string
+	for _, b := range backups {
+		if b.Kind == "c4gh" {
+			continue
+		}
+		group := b.Kind + "/" + b.Source
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], b)
+	}
+
+	expired := make(map[string]objectInfo)
+	for _, group := range order {
+		entries := groups[group]
+		policy, ok := policies.policyFor(entries[0].Kind, entries[0].Source)
+		if !ok {
+			log.Debugf("No retention policy for %s, keeping all backups", group)
+
+			continue
+		}
+
+		for _, d := range applyRetention(entries, policy) {
+			if d.keep {
+				log.Infof("keep   %s (%s)", d.backup.Name, d.reason)
+
+				continue
+			}
+
+			log.Infof("delete %s (%s)", d.backup.Name, d.reason)
+			expired[d.backup.Name] = objectInfo{}
+			if d.backup.Manifest {
+				expired[d.backup.Name+manifestSuffix] = objectInfo{}
+			}
+			for _, part := range d.backup.Parts {
+				expired[part] = objectInfo{}
+			}
+			for _, manifest := range d.backup.partManifests {
+				expired[manifest] = objectInfo{}
+			}
+		}
+	}
+
+	if dryRun {
+		log.Infof("Dry run, %d objects would be deleted", len(expired))
+
+		return nil
+	}
+
+	return sb.deleteObjects(expired)
+}
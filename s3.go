@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -26,6 +32,7 @@ type s3Backend struct {
 	Uploader   *s3manager.Uploader
 	Bucket     string
 	PathPrefix string
+	Workers    int
 }
 
 // S3Config stores information about the S3 storage backend
@@ -39,6 +46,7 @@ type S3Config struct {
 	Chunksize  int
 	Cacert     string
 	PathPrefix string
+	Workers    int
 }
 
 func newS3Backend(config S3Config) (*s3Backend, error) {
@@ -77,6 +85,7 @@ func newS3Backend(config S3Config) (*s3Backend, error) {
 		}),
 		Client:     s3.New(s3Session),
 		PathPrefix: config.PathPrefix,
+		Workers:    config.Workers,
 	}
 
 	_, err = sb.Client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: &config.Bucket})
@@ -109,13 +118,16 @@ func (sb *s3Backend) NewFileReader(filePath string) (io.ReadCloser, error) {
 	return r.Body, nil
 }
 
-// NewFileWriter uploads the contents of an io.Reader to a S3 bucket
+// NewFileWriter uploads the contents of an io.Reader to a S3 bucket. Close
+// waits for the upload to finish and returns its error, wg is done at the
+// same time.
 func (sb *s3Backend) NewFileWriter(filePath string, wg *sync.WaitGroup) (io.WriteCloser, error) {
 	if sb == nil {
 		return nil, fmt.Errorf("Invalid s3Backend")
 	}
 
 	reader, writer := io.Pipe()
+	uw := &uploadWriter{pw: writer, done: make(chan error, 1)}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -129,9 +141,50 @@ func (sb *s3Backend) NewFileWriter(filePath string, wg *sync.WaitGroup) (io.Writ
 		if err != nil {
 			_ = reader.CloseWithError(err)
 		}
+		uw.done <- err
 	}()
 
-	return writer, nil
+	return uw, nil
+}
+
+// uploadWriter is the writing end of an upload started by NewFileWriter
+type uploadWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close ends the data of the upload and returns once the object is stored
+func (w *uploadWriter) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+
+	return w.wait()
+}
+
+// wait returns the error of the upload once it has finished
+func (w *uploadWriter) wait() error {
+	w.once.Do(func() { w.err = <-w.done })
+
+	return w.err
+}
+
+// abortWriter closes a writer returned by NewFileWriter with err, so that the
+// pending upload is cancelled instead of storing a truncated object.
+func abortWriter(w io.WriteCloser, err error) {
+	if uw, ok := w.(*uploadWriter); ok {
+		_ = uw.pw.CloseWithError(err)
+		_ = uw.wait()
+
+		return
+	}
+	_ = w.Close()
 }
 
 // transportConfigS3 is a helper method to setup TLS for the S3 client.
@@ -166,163 +219,590 @@ func transportConfigS3(config S3Config) http.RoundTripper {
 	return trConfig
 }
 
-func BackupS3BucketEncrypted(source, destination *s3Backend, publicKeyPath string) error {
-	privateKey, publicKeyList, err := getKeys(publicKeyPath)
+// transferStats keeps track of the objects handled by a bucket action
+type transferStats struct {
+	seen    atomic.Int64
+	copied  atomic.Int64
+	skipped atomic.Int64
+	failed  atomic.Int64
+}
+
+// walkBucket calls fn for every object under the PathPrefix of the backend,
+// following the continuation tokens until the whole listing has been seen.
+func (sb *s3Backend) walkBucket(fn func(obj *s3.Object) error) error {
+	var walkErr error
+	err := sb.Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(sb.Bucket),
+		Prefix: aws.String(sb.PathPrefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			if walkErr = fn(obj); walkErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
 	if err != nil {
-		return fmt.Errorf("could not retrieve public key or generate private key: %s", err)
+		return err
 	}
 
-	// list files in src bucket
-	result, err := source.Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: &source.Bucket,
-		Prefix: &source.PathPrefix,
+	return walkErr
+}
+
+// transferObjects lists the source bucket and hands each object to a pool of
+// source.Workers goroutines running transfer. The transfer function reports
+// whether the object was copied or skipped. Errors are collected per object
+// so that one bad object does not stop the rest of the bucket from being
+// processed, they are returned together once all workers are done.
+func transferObjects(source *s3Backend, action string, transfer func(obj *s3.Object) (bool, error)) error {
+	workers := source.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		stats  transferStats
+		mu     sync.Mutex
+		errs   []error
+		wg     sync.WaitGroup
+		queued = make(chan *s3.Object, workers)
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range queued {
+				copied, err := transfer(obj)
+				switch {
+				case err != nil:
+					log.Errorf("failed to %s object %s: %v", action, *obj.Key, err)
+					stats.failed.Add(1)
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", *obj.Key, err))
+					mu.Unlock()
+				case copied:
+					stats.copied.Add(1)
+				default:
+					stats.skipped.Add(1)
+				}
+			}
+		}()
+	}
+
+	err := source.walkBucket(func(obj *s3.Object) error {
+		stats.seen.Add(1)
+		queued <- obj
+
+		return nil
 	})
+	close(queued)
+	wg.Wait()
+
+	log.Infof("%s finished, objects seen: %d, copied: %d, skipped: %d, failed: %d",
+		action, stats.seen.Load(), stats.copied.Load(), stats.skipped.Load(), stats.failed.Load())
+
 	if err != nil {
-		return err
+		errs = append(errs, fmt.Errorf("failed to list objects: %w", err))
 	}
 
-	wg := sync.WaitGroup{}
-	for _, obj := range result.Contents {
-		log.Debugf("copying object: %s", *obj.Key)
-		s, err := source.Client.GetObject(&s3.GetObjectInput{
-			Bucket: &source.Bucket,
-			Key:    obj.Key,
-		})
-		if err != nil {
-			return err
-		}
-		defer s.Body.Close()
+	return errors.Join(errs...)
+}
 
-		wr, err := destination.NewFileWriter(fmt.Sprintf("%s.c4gh", *obj.Key), &wg)
-		if err != nil {
-			return fmt.Errorf("could not open backup writer: %s", err)
+// bucketManifestName is the name of the object, stored below the source
+// PathPrefix in the destination bucket, that records what has been backed up
+const bucketManifestName = ".backup-manifest.json"
+
+// bucketManifest maps the source keys of a bucket backup to the state of the
+// object at the time it was encrypted. Recipients are the keys of the last
+// run, each entry records the keys its object is encrypted to.
+type bucketManifest struct {
+	Bucket     string                         `json:"bucket"`
+	Prefix     string                         `json:"prefix"`
+	Updated    time.Time                      `json:"updated"`
+	Recipients []string                       `json:"recipients"`
+	Objects    map[string]bucketManifestEntry `json:"objects"`
+	Signature  *manifestSignature             `json:"signature,omitempty"`
+}
+
+type bucketManifestEntry struct {
+	ETag            string    `json:"etag"`
+	Size            int64     `json:"size"`
+	BackedUp        time.Time `json:"backed_up"`
+	PlaintextSHA256 string    `json:"plaintext_sha256,omitempty"`
+	Recipients      []string  `json:"recipients,omitempty"`
+}
+
+// sameRecipients reports if two lists of key fingerprints hold the same keys
+func sameRecipients(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := make(map[string]bool, len(a))
+	for _, fingerprint := range a {
+		keys[fingerprint] = true
+	}
+	for _, fingerprint := range b {
+		if !keys[fingerprint] {
+			return false
 		}
+	}
 
-		e, err := newEncryptor(publicKeyList, privateKey, wr)
-		if err != nil {
-			return err
+	return true
+}
+
+func bucketManifestKey(prefix string) string {
+	if prefix == "" {
+		return bucketManifestName
+	}
+
+	return path.Join(prefix, bucketManifestName)
+}
+
+// readBucketManifest fetches the manifest for a source prefix from the backup
+// bucket, a missing manifest results in an empty one.
+func (sb *s3Backend) readBucketManifest(bucket, prefix string) (*bucketManifest, error) {
+	manifest := &bucketManifest{Bucket: bucket, Prefix: prefix, Objects: make(map[string]bucketManifestEntry)}
+
+	r, err := sb.Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(bucketManifestKey(prefix)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			log.Debugf("no backup manifest found for prefix: %q", prefix)
+
+			return manifest, nil
 		}
 
-		i, err := io.Copy(e, s.Body)
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("could not parse backup manifest: %s", err)
+	}
+	if manifest.Objects == nil {
+		manifest.Objects = make(map[string]bucketManifestEntry)
+	}
+
+	return manifest, nil
+}
+
+// writeBucketManifest signs the manifest, if a signing key is configured,
+// and stores it in the backup bucket.
+func (sb *s3Backend) writeBucketManifest(manifest *bucketManifest, signingKeyPath string) error {
+	manifest.Updated = time.Now().UTC()
+	manifest.Signature = nil
+	if signingKeyPath != "" {
+		key, err := readSigningKey(signingKeyPath)
 		if err != nil {
-			return fmt.Errorf("failed to copy data: %s", err.Error())
+			return fmt.Errorf("could not read manifest signing key: %s", err)
 		}
-		log.Debugf("bytes copied: %d", i)
-		err = e.Close()
+		payload, err := json.Marshal(manifest)
 		if err != nil {
 			return err
 		}
+		manifest.Signature = signPayload(key, payload)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	_, err = sb.Uploader.Upload(&s3manager.UploadInput{
+		Body:        bytes.NewReader(data),
+		Bucket:      aws.String(sb.Bucket),
+		Key:         aws.String(bucketManifestKey(manifest.Prefix)),
+		ContentType: aws.String("application/json"),
+	})
+
+	return err
+}
+
+// BackupS3BucketEncrypted encrypts the objects of the source bucket into the
+// destination bucket. Objects whose ETag and size match the backup manifest,
+// and that are encrypted to the configured keys, are already backed up and
+// are skipped.
+func BackupS3BucketEncrypted(source, destination *s3Backend, publicKeyPaths []string, signingKeyPath string) error {
+	privateKey, publicKeyList, err := getKeys(publicKeyPaths)
+	if err != nil {
+		return fmt.Errorf("could not retrieve public key or generate private key: %s", err)
+	}
+
+	manifest, err := destination.readBucketManifest(source.Bucket, source.PathPrefix)
+	if err != nil {
+		return fmt.Errorf("could not read backup manifest: %s", err)
+	}
+	log.Debugf("backup manifest lists %d objects", len(manifest.Objects))
+	recipients := keyFingerprints(publicKeyList)
+	manifest.Recipients = recipients
+
+	mu := sync.Mutex{}
+	err = transferObjects(source, "backup", func(obj *s3.Object) (bool, error) {
+		if strings.HasSuffix(*obj.Key, "/") {
+			log.Debugf("skipping folder object: %s", *obj.Key)
+
+			return false, nil
+		}
 
-		err = wr.Close()
+		mu.Lock()
+		entry, found := manifest.Objects[*obj.Key]
+		mu.Unlock()
+		if found && entry.ETag == aws.StringValue(obj.ETag) && entry.Size == aws.Int64Value(obj.Size) &&
+			sameRecipients(entry.Recipients, recipients) {
+			log.Debugf("skipping unchanged object: %s", *obj.Key)
+
+			return false, nil
+		}
+
+		checksum, err := backupObject(source, destination, obj, publicKeyList, privateKey)
 		if err != nil {
-			return err
+			return false, err
 		}
+
+		mu.Lock()
+		manifest.Objects[*obj.Key] = bucketManifestEntry{
+			ETag:            aws.StringValue(obj.ETag),
+			Size:            aws.Int64Value(obj.Size),
+			BackedUp:        time.Now().UTC(),
+			PlaintextSHA256: checksum,
+			Recipients:      recipients,
+		}
+		mu.Unlock()
+
+		return true, nil
+	})
+
+	// The manifest is written even if some objects failed, so that the
+	// successful ones are not encrypted again on the next run.
+	if merr := destination.writeBucketManifest(manifest, signingKeyPath); merr != nil {
+		return errors.Join(err, fmt.Errorf("could not write backup manifest: %s", merr))
 	}
-	wg.Wait()
 
-	return nil
+	return err
+}
+
+// backupObject encrypts a single object from the source bucket into the
+// destination bucket and returns the sha256 checksum of the plaintext. The
+// object body is closed when the upload has finished.
+func backupObject(source, destination *s3Backend, obj *s3.Object, publicKeyList [][32]byte, privateKey [32]byte) (string, error) {
+	log.Debugf("copying object: %s", *obj.Key)
+	s, err := source.Client.GetObject(&s3.GetObjectInput{
+		Bucket: &source.Bucket,
+		Key:    obj.Key,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer s.Body.Close()
+
+	wg := sync.WaitGroup{}
+	wr, err := destination.NewFileWriter(fmt.Sprintf("%s.c4gh", *obj.Key), &wg)
+	if err != nil {
+		return "", fmt.Errorf("could not open backup writer: %s", err)
+	}
+	defer wg.Wait()
+
+	e, err := newEncryptor(publicKeyList, privateKey, wr)
+	if err != nil {
+		abortWriter(wr, err)
+
+		return "", err
+	}
+
+	plaintext := newMeasuredWriter(e, true)
+	i, err := io.Copy(plaintext, s.Body)
+	if err != nil {
+		abortWriter(wr, err)
+
+		return "", fmt.Errorf("failed to copy data: %s", err.Error())
+	}
+	log.Debugf("bytes copied: %d", i)
+	err = e.Close()
+	if err != nil {
+		abortWriter(wr, err)
+
+		return "", err
+	}
+
+	// the upload of small objects only runs once the data is complete, so
+	// the object is not stored before Close has returned
+	if err := wr.Close(); err != nil {
+		return "", fmt.Errorf("could not upload encrypted object: %s", err)
+	}
+
+	return plaintext.sum(), nil
 }
 
-func RestoreEncryptedS3Bucket(source, destination *s3Backend, passphrase, privateKeyPath string) error {
-	privateKey, err := getPrivateKey(privateKeyPath, passphrase)
+func RestoreEncryptedS3Bucket(source, destination *s3Backend, privateKeys keySource) error {
+	privateKey, err := privateKeys.privateKey()
 	if err != nil {
 		return fmt.Errorf("private key error: %s", err)
 	}
 
-	// list files in src bucket
-	result, err := source.Client.ListObjectsV2(&s3.ListObjectsV2Input{
+	if err := checkFirstKey(source, privateKey); err != nil {
+		return err
+	}
+
+	return transferObjects(source, "restore", func(obj *s3.Object) (bool, error) {
+		if !strings.HasSuffix(*obj.Key, ".c4gh") {
+			log.Debugf("skipping non crypt4gh object: %s", *obj.Key)
+
+			return false, nil
+		}
+
+		return true, restoreObject(source, destination, obj, privateKey)
+	})
+}
+
+// restoreObject decrypts a single crypt4gh object from the source bucket into
+// the destination bucket, the object body is closed when the upload has finished.
+func restoreObject(source, destination *s3Backend, obj *s3.Object, privateKey [32]byte) error {
+	log.Debugf("restoring object: %s", *obj.Key)
+	s, err := source.Client.GetObject(&s3.GetObjectInput{
 		Bucket: &source.Bucket,
-		Prefix: &source.PathPrefix,
+		Key:    obj.Key,
 	})
 	if err != nil {
 		return err
 	}
+	defer s.Body.Close()
 
-	wg := sync.WaitGroup{}
-	for _, obj := range result.Contents {
-		wg.Add(1)
-		log.Debugf("restoring object: %s", *obj.Key)
-		s, err := source.Client.GetObject(&s3.GetObjectInput{
-			Bucket: &source.Bucket,
-			Key:    obj.Key,
+	uploadErr := make(chan error, 1)
+	reader, wr := io.Pipe()
+	go func() {
+		_, err := destination.Uploader.Upload(&s3manager.UploadInput{
+			Body:            reader,
+			Bucket:          aws.String(destination.Bucket),
+			Key:             aws.String(strings.TrimSuffix(*obj.Key, ".c4gh")),
+			ContentEncoding: aws.String("application/octet-stream"),
 		})
 		if err != nil {
-			return err
+			_ = reader.CloseWithError(err)
 		}
-		defer s.Body.Close()
+		uploadErr <- err
+	}()
 
-		reader, wr := io.Pipe()
-		go func() {
-			defer wg.Done()
-			_, err := destination.Uploader.Upload(&s3manager.UploadInput{
-				Body:            reader,
-				Bucket:          aws.String(destination.Bucket),
-				Key:             aws.String(strings.TrimSuffix(*obj.Key, ".c4gh")),
-				ContentEncoding: aws.String("application/octet-stream"),
-			})
-			if err != nil {
-				_ = reader.CloseWithError(err)
-			}
-		}()
+	d, err := newDecryptor(privateKey, s.Body)
+	if err != nil {
+		log.Error("c4gh decryptor failure")
+		_ = wr.CloseWithError(err)
+		<-uploadErr
 
-		d, err := newDecryptor(privateKey, s.Body)
-		if err != nil {
-			log.Error("c4gh decryptor failure")
+		return err
+	}
 
-			return err
+	i, err := io.Copy(wr, d)
+	if err != nil {
+		_ = wr.CloseWithError(err)
+		<-uploadErr
+
+		return fmt.Errorf("failed to copy data: %s", err.Error())
+	}
+	log.Debugf("bytes copied: %d", i)
+
+	if err := d.Close(); err != nil {
+		_ = wr.CloseWithError(err)
+		<-uploadErr
+
+		return err
+	}
+
+	if err := wr.Close(); err != nil {
+		return err
+	}
+
+	return <-uploadErr
+}
+
+// syncConfig holds the options for incremental bucket syncs
+type syncConfig struct {
+	// compare selects how objects already in the destination are checked,
+	// one of "size", "etag" or "modified". Empty copies every object.
+	compare string
+	// mirror removes destination objects that no longer exist in the source
+	mirror bool
+}
+
+// sourceETagMetadata is the user metadata key that records the ETag of the
+// source object on a synced copy. Copies uploaded in several parts get an
+// ETag of their own, so this is what the etag compare mode checks them by.
+const sourceETagMetadata = "Source-Etag"
+
+// objectInfo is the part of a bucket listing used to detect changed objects
+type objectInfo struct {
+	size       int64
+	etag       string
+	modified   time.Time
+	sourceETag string
+}
+
+// listObjectInfo indexes every object below prefix in the bucket by key.
+func (sb *s3Backend) listObjectInfo(prefix string) (map[string]objectInfo, error) {
+	index := make(map[string]objectInfo)
+	listing := *sb
+	listing.PathPrefix = prefix
+	err := listing.walkBucket(func(obj *s3.Object) error {
+		index[*obj.Key] = objectInfo{
+			size:     aws.Int64Value(obj.Size),
+			etag:     aws.StringValue(obj.ETag),
+			modified: aws.TimeValue(obj.LastModified),
 		}
 
-		i, err := io.Copy(wr, d)
+		return nil
+	})
+
+	return index, err
+}
+
+// unchanged reports if the destination copy of obj is up to date according
+// to the compare mode of the sync.
+func (conf syncConfig) unchanged(obj *s3.Object, dst objectInfo) bool {
+	switch conf.compare {
+	case "size":
+		return aws.Int64Value(obj.Size) == dst.size
+	case "etag":
+		return aws.StringValue(obj.ETag) == dst.etag || aws.StringValue(obj.ETag) == dst.sourceETag
+	case "modified":
+		return !aws.TimeValue(obj.LastModified).After(dst.modified)
+	}
+
+	return false
+}
+
+func SyncS3Buckets(source, destination *s3Backend, conf syncConfig) error {
+	switch conf.compare {
+	case "", "size", "etag", "modified":
+	default:
+		return fmt.Errorf("unknown sync compare mode: %s", conf.compare)
+	}
+
+	var (
+		mu      sync.Mutex
+		present map[string]objectInfo
+	)
+	if conf.compare != "" || conf.mirror {
+		var err error
+		present, err = destination.listObjectInfo(source.PathPrefix)
 		if err != nil {
-			return fmt.Errorf("failed to copy data: %s", err.Error())
+			return fmt.Errorf("failed to list destination objects: %w", err)
 		}
-		log.Debugf("bytes copied: %d", i)
+		log.Debugf("found %d objects in destination", len(present))
+	}
 
-		err = d.Close()
-		if err != nil {
-			return err
+	err := transferObjects(source, "sync", func(obj *s3.Object) (bool, error) {
+		mu.Lock()
+		dst, exists := present[*obj.Key]
+		delete(present, *obj.Key)
+		mu.Unlock()
+
+		if strings.HasSuffix(*obj.Key, "/") {
+			log.Debugf("skipping folder object: %s", *obj.Key)
+
+			return false, nil
 		}
 
-		err = wr.Close()
-		if err != nil {
-			return err
+		if exists && conf.compare == "etag" && aws.StringValue(obj.ETag) != dst.etag {
+			dst.sourceETag = destination.sourceETag(*obj.Key)
 		}
-	}
-	wg.Wait()
+		if exists && conf.unchanged(obj, dst) {
+			log.Debugf("skipping unchanged object: %s", *obj.Key)
 
-	return nil
-}
+			return false, nil
+		}
 
-func SyncS3Buckets(source, destination *s3Backend) error {
-	result, err := source.Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: &source.Bucket,
-		Prefix: &source.PathPrefix,
+		return true, syncObject(source, destination, obj)
 	})
 	if err != nil {
 		return err
 	}
 
-	for _, obj := range result.Contents {
-		log.Debugf("copying object: %s", *obj.Key)
-		s, err := source.Client.GetObject(&s3.GetObjectInput{
-			Bucket: &source.Bucket,
-			Key:    obj.Key,
+	if conf.mirror {
+		return destination.deleteObjects(present)
+	}
+
+	return nil
+}
+
+// deleteObjects removes the given keys from the bucket, in batches of the
+// maximum size allowed by DeleteObjects.
+func (sb *s3Backend) deleteObjects(objects map[string]objectInfo) error {
+	batch := make([]*s3.ObjectIdentifier, 0, 1000)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := sb.Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(sb.Bucket),
+			Delete: &s3.Delete{Objects: batch, Quiet: aws.Bool(true)},
 		})
 		if err != nil {
 			return err
 		}
-		defer s.Body.Close()
+		if len(res.Errors) > 0 {
+			return fmt.Errorf("failed to delete %s: %s", aws.StringValue(res.Errors[0].Key), aws.StringValue(res.Errors[0].Message))
+		}
+		batch = batch[:0]
 
-		_, err = destination.Uploader.Upload(&s3manager.UploadInput{
-			Body:            s.Body,
-			Bucket:          aws.String(destination.Bucket),
-			Key:             obj.Key,
-			ContentEncoding: aws.String("application/octet-stream"),
-		})
-		if err != nil {
-			return err
+		return nil
+	}
+
+	for key := range objects {
+		log.Debugf("deleting object: %s", key)
+		batch = append(batch, &s3.ObjectIdentifier{Key: aws.String(key)})
+		if len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return err
+			}
 		}
 	}
+	if err := flush(); err != nil {
+		return err
+	}
+	log.Infof("objects deleted from bucket %s: %d", sb.Bucket, len(objects))
 
 	return nil
 }
+
+// sourceETag returns the ETag of the source object a synced copy was made
+// from, or an empty string if it is not known
+func (sb *s3Backend) sourceETag(key string) string {
+	head, err := sb.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Debugf("could not read metadata of %s: %v", key, err)
+
+		return ""
+	}
+
+	return aws.StringValue(head.Metadata[sourceETagMetadata])
+}
+
+// syncObject copies a single object unmodified from the source bucket into the
+// destination bucket, with the ETag of the source recorded in its metadata.
+func syncObject(source, destination *s3Backend, obj *s3.Object) error {
+	log.Debugf("copying object: %s", *obj.Key)
+	s, err := source.Client.GetObject(&s3.GetObjectInput{
+		Bucket: &source.Bucket,
+		Key:    obj.Key,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Body.Close()
+
+	_, err = destination.Uploader.Upload(&s3manager.UploadInput{
+		Body:            s.Body,
+		Bucket:          aws.String(destination.Bucket),
+		Key:             obj.Key,
+		ContentEncoding: aws.String("application/octet-stream"),
+		Metadata:        map[string]*string{sourceETagMetadata: obj.ETag},
+	})
+
+	return err
+}
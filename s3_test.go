@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -44,6 +49,7 @@ func (suite *S3TestSuite) SetupSuite() {
 		10,
 		"",
 		"",
+		4,
 	}
 
 	suite.PublicKey, suite.PrivateKey, err = keys.GenerateKeyPair()
@@ -174,7 +180,7 @@ func (suite *S3TestSuite) TestBackupAndRestoreS3BucketEncrypted() {
 		suite.T().FailNow()
 	}
 
-	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, suite.PublicKeyPath), "failed to sync bucket")
+	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, []string{suite.PublicKeyPath}, ""), "failed to sync bucket")
 
 	backedup, err := dst.Client.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket: &dst.Bucket,
@@ -183,7 +189,23 @@ func (suite *S3TestSuite) TestBackupAndRestoreS3BucketEncrypted() {
 	if err != nil {
 		suite.T().Error()
 	}
-	assert.Equal(suite.T(), 5, int(*backedup.KeyCount))
+	// the encrypted objects and the backup manifest
+	assert.Equal(suite.T(), 6, int(*backedup.KeyCount))
+
+	manifest, err := dst.readBucketManifest(src.Bucket, src.PathPrefix)
+	assert.NoError(suite.T(), err, "failed to read backup manifest")
+	assert.Equal(suite.T(), 5, len(manifest.Objects))
+	for _, so := range source.Contents {
+		assert.Equal(suite.T(), *so.ETag, manifest.Objects[*so.Key].ETag)
+	}
+
+	// a second run finds nothing new to back up
+	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, []string{suite.PublicKeyPath}, ""), "failed to sync bucket")
+	unchanged, err := dst.readBucketManifest(src.Bucket, src.PathPrefix)
+	assert.NoError(suite.T(), err, "failed to read backup manifest")
+	for key, entry := range manifest.Objects {
+		assert.Equal(suite.T(), entry.BackedUp, unchanged.Objects[key].BackedUp, "unchanged object was backed up again")
+	}
 
 	b := 0
 	for _, so := range source.Contents {
@@ -203,7 +225,7 @@ func (suite *S3TestSuite) TestBackupAndRestoreS3BucketEncrypted() {
 	restore, err := newS3Backend(restConf)
 	assert.NoError(suite.T(), err, "failed to create restore backend")
 
-	assert.NoError(suite.T(), RestoreEncryptedS3Bucket(dst, restore, string(suite.Passphrase), suite.PrivateKeyPath), "failed to restore bucket")
+	assert.NoError(suite.T(), RestoreEncryptedS3Bucket(dst, restore, fileKeySource{path: suite.PrivateKeyPath, passphrase: passphrase{value: string(suite.Passphrase)}}), "failed to restore bucket")
 
 	restored, err := restore.Client.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket: &restore.Bucket,
@@ -249,7 +271,7 @@ func (suite *S3TestSuite) TestBackupAndRestoreS3BucketSubPathEncrypted() {
 		suite.T().Logf("failed to create destination backend, reason :%s", err.Error())
 		suite.T().FailNow()
 	}
-	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, suite.PublicKeyPath), "failed to sync bucket")
+	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, []string{suite.PublicKeyPath}, ""), "failed to sync bucket")
 
 	backup, err := dst.Client.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket: &dst.Bucket,
@@ -258,7 +280,8 @@ func (suite *S3TestSuite) TestBackupAndRestoreS3BucketSubPathEncrypted() {
 	if err != nil {
 		suite.T().Error()
 	}
-	assert.Equal(suite.T(), 2, int(*backup.KeyCount))
+	// the encrypted objects and the backup manifest
+	assert.Equal(suite.T(), 3, int(*backup.KeyCount))
 
 	b := 0
 	for _, so := range source.Contents {
@@ -278,7 +301,7 @@ func (suite *S3TestSuite) TestBackupAndRestoreS3BucketSubPathEncrypted() {
 	restore, err := newS3Backend(restConf)
 	assert.NoError(suite.T(), err, "failed to create restore backend")
 
-	assert.NoError(suite.T(), RestoreEncryptedS3Bucket(dst, restore, string(suite.Passphrase), suite.PrivateKeyPath), "failed to restore bucket")
+	assert.NoError(suite.T(), RestoreEncryptedS3Bucket(dst, restore, fileKeySource{path: suite.PrivateKeyPath, passphrase: passphrase{value: string(suite.Passphrase)}}), "failed to restore bucket")
 
 	restored, err := restore.Client.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket: &restore.Bucket,
@@ -302,6 +325,44 @@ func (suite *S3TestSuite) TestBackupAndRestoreS3BucketSubPathEncrypted() {
 	assert.Equal(suite.T(), 2, r, "not all objects restored")
 }
 
+func (suite *S3TestSuite) TestBackupS3BucketEncryptedNewRecipient() {
+	srcConf := suite.Conf
+	srcConf.PathPrefix = "foo/bar"
+	src, err := newS3Backend(srcConf)
+	assert.NoError(suite.T(), err, "failed to create source backend")
+
+	dstConf := suite.Conf
+	dstConf.Bucket = "rotated"
+	dst, err := newS3Backend(dstConf)
+	if err != nil {
+		suite.T().Logf("failed to create destination backend, reason :%s", err.Error())
+		suite.T().FailNow()
+	}
+
+	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, []string{suite.PublicKeyPath}, ""), "failed to back up bucket")
+	first, err := dst.readBucketManifest(src.Bucket, src.PathPrefix)
+	assert.NoError(suite.T(), err, "failed to read backup manifest")
+	assert.Equal(suite.T(), 2, len(first.Objects))
+
+	escrowKey, _, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	escrowPath := filepath.Join(filepath.Dir(suite.PublicKeyPath), "escrow.pub")
+	escrow, err := os.Create(escrowPath)
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), keys.WriteCrypt4GHX25519PublicKey(escrow, escrowKey))
+	assert.NoError(suite.T(), escrow.Close())
+
+	// unchanged objects are encrypted again for the added key
+	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, []string{suite.PublicKeyPath, escrowPath}, ""), "failed to back up bucket")
+	second, err := dst.readBucketManifest(src.Bucket, src.PathPrefix)
+	assert.NoError(suite.T(), err, "failed to read backup manifest")
+	for key, entry := range second.Objects {
+		assert.NotEqual(suite.T(), first.Objects[key].BackedUp, entry.BackedUp, "object was not encrypted for the new key")
+		assert.Equal(suite.T(), second.Recipients, entry.Recipients)
+		assert.Equal(suite.T(), 2, len(entry.Recipients))
+	}
+}
+
 func (suite *S3TestSuite) TestSyncS3Buckets() {
 	srcConf := suite.Conf
 	src, err := newS3Backend(srcConf)
@@ -324,7 +385,7 @@ func (suite *S3TestSuite) TestSyncS3Buckets() {
 		suite.T().Logf("failed to create destination backend, reason :%s", err.Error())
 		suite.T().FailNow()
 	}
-	assert.NoError(suite.T(), SyncS3Buckets(src, dst), "failed to sync bucket")
+	assert.NoError(suite.T(), SyncS3Buckets(src, dst, syncConfig{}), "failed to sync bucket")
 
 	destination, err := dst.Client.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket: &dst.Bucket,
@@ -347,3 +408,513 @@ func (suite *S3TestSuite) TestSyncS3Buckets() {
 	}
 	assert.Equal(suite.T(), 5, b, "not all objects synced")
 }
+
+func (suite *S3TestSuite) TestSyncS3BucketsPaginated() {
+	srcConf := suite.Conf
+	srcConf.Bucket = "paged"
+	src, err := newS3Backend(srcConf)
+	assert.NoError(suite.T(), err, "failed to create source backend")
+
+	// more objects than fit in a single ListObjectsV2 page
+	for i := 0; i < 1010; i++ {
+		_, err = src.Client.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader([]byte(fmt.Sprintf("object %d", i))),
+			Bucket: aws.String(src.Bucket),
+			Key:    aws.String(fmt.Sprintf("paged/%04d", i)),
+		})
+		if err != nil {
+			suite.T().Logf("failed to upload files to bucket, reason: %s", err.Error())
+			suite.T().FailNow()
+		}
+	}
+
+	dstConf := suite.Conf
+	dstConf.Bucket = "paged-sync"
+	dst, err := newS3Backend(dstConf)
+	if err != nil {
+		suite.T().Logf("failed to create destination backend, reason :%s", err.Error())
+		suite.T().FailNow()
+	}
+	assert.NoError(suite.T(), SyncS3Buckets(src, dst, syncConfig{}), "failed to sync bucket")
+
+	synced := 0
+	assert.NoError(suite.T(), dst.walkBucket(func(_ *s3.Object) error {
+		synced++
+
+		return nil
+	}))
+	assert.Equal(suite.T(), 1010, synced, "not all objects synced")
+}
+
+func (suite *S3TestSuite) TestTransferObjectsFailingObject() {
+	srcConf := suite.Conf
+	srcConf.Bucket = "workers"
+	src, err := newS3Backend(srcConf)
+	assert.NoError(suite.T(), err, "failed to create source backend")
+
+	for i := 0; i < 20; i++ {
+		_, err = src.Client.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader([]byte(fmt.Sprintf("object %d", i))),
+			Bucket: aws.String(src.Bucket),
+			Key:    aws.String(fmt.Sprintf("workers/%02d", i)),
+		})
+		if err != nil {
+			suite.T().Logf("failed to upload files to bucket, reason: %s", err.Error())
+			suite.T().FailNow()
+		}
+	}
+
+	dstConf := suite.Conf
+	dstConf.Bucket = "workers-sync"
+	dst, err := newS3Backend(dstConf)
+	if err != nil {
+		suite.T().Logf("failed to create destination backend, reason :%s", err.Error())
+		suite.T().FailNow()
+	}
+
+	err = transferObjects(src, "sync", func(obj *s3.Object) (bool, error) {
+		if *obj.Key == "workers/07" {
+			return false, fmt.Errorf("broken object")
+		}
+
+		return true, syncObject(src, dst, obj)
+	})
+	assert.Error(suite.T(), err, "failing object was not reported")
+	assert.Contains(suite.T(), err.Error(), "workers/07: broken object")
+
+	synced, err := dst.listObjectInfo("")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 19, len(synced), "failing object stopped the others")
+	assert.NotContains(suite.T(), synced, "workers/07")
+}
+
+func (suite *S3TestSuite) TestSyncS3BucketsIncrementalMirror() {
+	srcConf := suite.Conf
+	src, err := newS3Backend(srcConf)
+	assert.NoError(suite.T(), err, "failed to create source backend")
+
+	dstConf := suite.Conf
+	dstConf.Bucket = "incremental"
+	dst, err := newS3Backend(dstConf)
+	if err != nil {
+		suite.T().Logf("failed to create destination backend, reason :%s", err.Error())
+		suite.T().FailNow()
+	}
+	assert.NoError(suite.T(), SyncS3Buckets(src, dst, syncConfig{}), "failed to sync bucket")
+
+	first, err := dst.listObjectInfo("")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5, len(first))
+
+	_, err = dst.Client.PutObject(&s3.PutObjectInput{
+		Body:   bytes.NewReader([]byte("stale")),
+		Bucket: aws.String(dst.Bucket),
+		Key:    aws.String("foo/stale.file"),
+	})
+	assert.NoError(suite.T(), err, "failed to upload stale object")
+
+	assert.NoError(suite.T(), SyncS3Buckets(src, dst, syncConfig{compare: "etag", mirror: true}), "failed to sync bucket")
+
+	second, err := dst.listObjectInfo("")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5, len(second))
+	assert.NotContains(suite.T(), second, "foo/stale.file")
+	for key, info := range first {
+		assert.Equal(suite.T(), info.modified, second[key].modified, "unchanged object was copied again")
+	}
+
+	assert.Error(suite.T(), SyncS3Buckets(src, dst, syncConfig{compare: "checksum"}))
+}
+
+func (suite *S3TestSuite) TestSyncS3BucketsEtagMultipart() {
+	srcConf := suite.Conf
+	srcConf.Bucket = "large"
+	src, err := newS3Backend(srcConf)
+	assert.NoError(suite.T(), err, "failed to create source backend")
+
+	// uploaded in one part, its copy is uploaded in several
+	_, err = src.Client.PutObject(&s3.PutObjectInput{
+		Body:   bytes.NewReader(bytes.Repeat([]byte("x"), 6*1024*1024)),
+		Bucket: aws.String(src.Bucket),
+		Key:    aws.String("large/object"),
+	})
+	assert.NoError(suite.T(), err, "failed to upload large object")
+
+	dstConf := suite.Conf
+	dstConf.Bucket = "large-sync"
+	dst, err := newS3Backend(dstConf)
+	if err != nil {
+		suite.T().Logf("failed to create destination backend, reason :%s", err.Error())
+		suite.T().FailNow()
+	}
+	assert.NoError(suite.T(), SyncS3Buckets(src, dst, syncConfig{compare: "etag"}), "failed to sync bucket")
+
+	first, err := dst.listObjectInfo("")
+	assert.NoError(suite.T(), err)
+	assert.Contains(suite.T(), first["large/object"].etag, "-", "copy was not uploaded in parts")
+
+	time.Sleep(time.Second)
+	assert.NoError(suite.T(), SyncS3Buckets(src, dst, syncConfig{compare: "etag"}), "failed to sync bucket")
+
+	second, err := dst.listObjectInfo("")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), first["large/object"].modified, second["large/object"].modified, "unchanged object was copied again")
+}
+
+func (suite *S3TestSuite) TestFileWriterUploadError() {
+	sb, err := newS3Backend(suite.Conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	// small objects are only uploaded once the writer is closed
+	missing := *sb
+	missing.Bucket = "no-such-bucket"
+	wg := sync.WaitGroup{}
+	wr, err := missing.NewFileWriter("small.file", &wg)
+	assert.NoError(suite.T(), err)
+	_, err = wr.Write([]byte("small object"))
+	assert.NoError(suite.T(), err)
+	assert.Error(suite.T(), wr.Close(), "failed upload was not reported")
+	wg.Wait()
+}
+
+func (suite *S3TestSuite) TestWriteAndReadManifest() {
+	conf := suite.Conf
+	conf.Bucket = "manifests"
+	sb, err := newS3Backend(conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(suite.T(), err, "failed to generate signing key")
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	assert.NoError(suite.T(), err, "failed to marshal signing key")
+	signingKeyPath := filepath.Join(filepath.Dir(suite.PublicKeyPath), "signing.pem")
+	err = os.WriteFile(signingKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	assert.NoError(suite.T(), err, "failed to write signing key")
+
+	manifest := newBackupManifest("20240101120000-db.sqldump", "postgres", "db")
+	manifest.Recipients = keyFingerprints([][32]byte{suite.PublicKey})
+	plaintext := newMeasuredWriter(io.Discard, true)
+	_, _ = plaintext.Write([]byte("plaintext"))
+	manifest.finish(plaintext, newMeasuredWriter(io.Discard, false))
+	assert.NoError(suite.T(), sb.writeManifest(manifest, signingKeyPath))
+
+	stored, err := sb.readManifest("20240101120000-db.sqldump")
+	assert.NoError(suite.T(), err, "failed to read manifest")
+	assert.Equal(suite.T(), int64(9), stored.PlaintextBytes)
+	assert.Equal(suite.T(), keyFingerprint(suite.PublicKey), stored.Recipients[0])
+	assert.NoError(suite.T(), stored.verify(pub))
+
+	stored.PlaintextBytes++
+	assert.Error(suite.T(), stored.verify(pub), "tampered manifest verified")
+}
+
+func (suite *S3TestSuite) TestListBackups() {
+	conf := suite.Conf
+	conf.Bucket = "catalog"
+	sb, err := newS3Backend(conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	for _, key := range []string{
+		"20240101120000-db.sqldump",
+		"20240102120000-db.sqldump",
+		"20240102120000-db.sqldump.manifest.json",
+		"20240102130000-other.archive",
+		"index.bup",
+		"foo/bar.c4gh",
+		"unrelated.txt",
+	} {
+		_, err = sb.Client.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader([]byte(key)),
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(key),
+		})
+		assert.NoError(suite.T(), err, "failed to upload object")
+	}
+
+	backups, err := listBackups(sb)
+	assert.NoError(suite.T(), err, "failed to list backups")
+	assert.Equal(suite.T(), 5, len(backups))
+
+	assert.Equal(suite.T(), "archive", backups[0].Kind)
+	assert.Equal(suite.T(), "other", backups[0].Source)
+	assert.Equal(suite.T(), "c4gh", backups[2].Kind)
+	assert.Equal(suite.T(), "foo", backups[2].Source)
+
+	// newest dump first
+	assert.Equal(suite.T(), "20240102120000-db.sqldump", backups[3].Name)
+	assert.True(suite.T(), backups[3].Manifest)
+	assert.Equal(suite.T(), "20240101120000-db.sqldump", backups[4].Name)
+	assert.False(suite.T(), backups[4].Manifest)
+	assert.Equal(suite.T(), "db", backups[4].Source)
+
+	out := new(bytes.Buffer)
+	assert.NoError(suite.T(), printBackups(out, backups, "json"))
+	assert.Contains(suite.T(), out.String(), `"kind": "bup"`)
+
+	out.Reset()
+	assert.NoError(suite.T(), printBackups(out, backups, "table"))
+	assert.Contains(suite.T(), out.String(), "index.bup")
+
+	assert.Error(suite.T(), printBackups(out, backups, "xml"))
+}
+
+func (suite *S3TestSuite) TestResolveBackupName() {
+	conf := suite.Conf
+	conf.Bucket = "resolve"
+	sb, err := newS3Backend(conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	for _, key := range []string{
+		"20240101120000-db.sqldump",
+		"20240102120000-db.sqldump",
+		"20240103120000-other.sqldump",
+		"20240104120000-db.archive",
+	} {
+		_, err = sb.Client.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader([]byte(key)),
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(key),
+		})
+		assert.NoError(suite.T(), err, "failed to upload object")
+	}
+
+	name, err := resolveBackupName(sb, "20240101120000-db.sqldump", "", ".sqldump", "db")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "20240101120000-db.sqldump", name)
+
+	name, err = resolveBackupName(sb, "latest", "", ".sqldump", "db")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "20240102120000-db.sqldump", name)
+
+	name, err = resolveBackupName(sb, "latest", "", ".sqldump", "")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "20240103120000-other.sqldump", name)
+
+	name, err = resolveBackupName(sb, "latest", "20240102000000", ".sqldump", "db")
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), "20240101120000-db.sqldump", name)
+
+	_, err = resolveBackupName(sb, "latest", "20240101000000", ".sqldump", "db")
+	assert.Error(suite.T(), err, "found backup before the first one")
+
+	_, err = resolveBackupName(sb, "latest", "yesterday", ".sqldump", "db")
+	assert.Error(suite.T(), err, "accepted invalid timestamp")
+
+	_, err = resolveBackupName(sb, "20240101120000-db.sqldump", "20240101000000", ".sqldump", "db")
+	assert.Error(suite.T(), err, "accepted --before without latest")
+}
+
+func (suite *S3TestSuite) TestPruneBackups() {
+	conf := suite.Conf
+	conf.Bucket = "prune"
+	sb, err := newS3Backend(conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	keys := []string{"20240101120000-other.archive"}
+	for day := 1; day <= 20; day++ {
+		keys = append(keys, fmt.Sprintf("202401%02d120000-db.sqldump", day))
+	}
+	// an older backup with a manifest is the last good one
+	keys = append(keys, "20231201120000-db.sqldump", "20231201120000-db.sqldump.manifest.json")
+	for _, key := range keys {
+		_, err = sb.Client.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader([]byte(key)),
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(key),
+		})
+		assert.NoError(suite.T(), err, "failed to upload object")
+	}
+
+	policies := retentionConfig{
+		"sqldump":    {daily: 7, weekly: 4},
+		"sqldump/db": {daily: 3},
+	}
+
+	assert.NoError(suite.T(), pruneBackups(sb, policies, true))
+	backups, err := listBackups(sb)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 22, len(backups), "dry run deleted backups")
+
+	assert.NoError(suite.T(), pruneBackups(sb, policies, false))
+	backups, err = listBackups(sb)
+	assert.NoError(suite.T(), err)
+
+	var kept []string
+	for _, b := range backups {
+		kept = append(kept, b.Name)
+	}
+	assert.ElementsMatch(suite.T(), []string{
+		"20240101120000-other.archive",
+		"20240120120000-db.sqldump",
+		"20240119120000-db.sqldump",
+		"20240118120000-db.sqldump",
+		"20231201120000-db.sqldump",
+	}, kept)
+
+	// a policy that keeps nothing still leaves the newest backup
+	assert.NoError(suite.T(), pruneBackups(sb, retentionConfig{"archive": {}}, false))
+	backups, err = listBackups(sb)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 5, len(backups))
+}
+
+func (suite *S3TestSuite) TestPruneBackupsParts() {
+	conf := suite.Conf
+	conf.Bucket = "prune-parts"
+	sb, err := newS3Backend(conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	var keys []string
+	for _, name := range []string{"20240101120000-index.bup", "20240102120000-index.bup"} {
+		keys = append(keys, name, name+manifestSuffix)
+		for part := 0; part < 3; part++ {
+			keys = append(keys, fmt.Sprintf("%s.part-%03d", name, part), fmt.Sprintf("%s.part-%03d%s", name, part, manifestSuffix))
+		}
+	}
+	for _, key := range keys {
+		_, err = sb.Client.PutObject(&s3.PutObjectInput{
+			Body:   bytes.NewReader([]byte(key)),
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(key),
+		})
+		assert.NoError(suite.T(), err, "failed to upload object")
+	}
+
+	backups, err := listBackups(sb)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, len(backups), "parts listed as backups")
+	assert.Equal(suite.T(), []string{
+		"20240102120000-index.bup.part-000",
+		"20240102120000-index.bup.part-001",
+		"20240102120000-index.bup.part-002",
+	}, backups[0].Parts)
+	assert.Equal(suite.T(), int64(len("20240102120000-index.bup")+3*len("20240102120000-index.bup.part-000")), backups[0].Size)
+
+	assert.NoError(suite.T(), pruneBackups(sb, retentionConfig{"bup": {daily: 1}}, false))
+
+	var remaining []string
+	assert.NoError(suite.T(), sb.walkBucket(func(obj *s3.Object) error {
+		remaining = append(remaining, *obj.Key)
+
+		return nil
+	}))
+	assert.ElementsMatch(suite.T(), keys[len(keys)/2:], remaining)
+}
+
+func (suite *S3TestSuite) TestReencryptBackups() {
+	conf := suite.Conf
+	conf.Bucket = "rekeyed"
+	sb, err := newS3Backend(conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	// one object small enough to be uploaded again and one that is rewritten
+	// with a multipart copy
+	objects := map[string][]byte{
+		"small.c4gh": []byte("small backup"),
+		"large.c4gh": make([]byte, reencryptPartSize+1024*1024),
+	}
+	_, err = rand.Read(objects["large.c4gh"])
+	assert.NoError(suite.T(), err)
+
+	_, publicKeyList, err := getKeys([]string{suite.PublicKeyPath})
+	assert.NoError(suite.T(), err, "failed to read public key")
+	for key, data := range objects {
+		var buf bytes.Buffer
+		e, err := newEncryptor(publicKeyList, suite.PrivateKey, &buf)
+		assert.NoError(suite.T(), err)
+		_, err = e.Write(data)
+		assert.NoError(suite.T(), err)
+		assert.NoError(suite.T(), e.Close())
+
+		_, err = sb.Uploader.Upload(&s3manager.UploadInput{
+			Body:   &buf,
+			Bucket: aws.String(sb.Bucket),
+			Key:    aws.String(key),
+		})
+		assert.NoError(suite.T(), err, "failed to upload object")
+	}
+
+	newPublicKey, newPrivateKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), reencryptBackups(sb, suite.PrivateKey, [][32]byte{newPublicKey}, "", ""))
+
+	for key, data := range objects {
+		fr, err := sb.NewFileReader(key)
+		assert.NoError(suite.T(), err)
+		_, err = newDecryptor(suite.PrivateKey, fr)
+		assert.Error(suite.T(), err, "old key can still read %s", key)
+		fr.Close()
+
+		fr, err = sb.NewFileReader(key)
+		assert.NoError(suite.T(), err)
+		r, err := newDecryptor(newPrivateKey, fr)
+		assert.NoError(suite.T(), err, "new key can not read %s", key)
+		plaintext, err := io.ReadAll(r)
+		assert.NoError(suite.T(), err)
+		assert.Equal(suite.T(), data, plaintext, "data of %s changed", key)
+		fr.Close()
+	}
+}
+
+func (suite *S3TestSuite) TestCheckKey() {
+	conf := suite.Conf
+	conf.Bucket = "keycheck"
+	sb, err := newS3Backend(conf)
+	assert.NoError(suite.T(), err, "failed to create backend")
+
+	_, publicKeyList, err := getKeys([]string{suite.PublicKeyPath})
+	assert.NoError(suite.T(), err, "failed to read public key")
+	var buf bytes.Buffer
+	e, err := newEncryptor(publicKeyList, suite.PrivateKey, &buf)
+	assert.NoError(suite.T(), err)
+	_, err = e.Write(make([]byte, 2*headerRangeSize))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), e.Close())
+	_, err = sb.Uploader.Upload(&s3manager.UploadInput{
+		Body:   &buf,
+		Bucket: aws.String(sb.Bucket),
+		Key:    aws.String("20240101120000-db.sqldump"),
+	})
+	assert.NoError(suite.T(), err, "failed to upload object")
+
+	fingerprint, err := sb.checkKey("20240101120000-db.sqldump", suite.PrivateKey)
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), keyFingerprint(suite.PublicKey), fingerprint)
+
+	_, otherKey, err := keys.GenerateKeyPair()
+	assert.NoError(suite.T(), err)
+	_, err = sb.checkKey("20240101120000-db.sqldump", otherKey)
+	assert.ErrorContains(suite.T(), err, "can not decrypt")
+	assert.Error(suite.T(), checkKeys(sb, otherKey, ""))
+}
+
+func (suite *S3TestSuite) TestVerifyBackup() {
+	src, err := newS3Backend(suite.Conf)
+	assert.NoError(suite.T(), err, "failed to create source backend")
+
+	dstConf := suite.Conf
+	dstConf.Bucket = "verified"
+	dst, err := newS3Backend(dstConf)
+	assert.NoError(suite.T(), err, "failed to create destination backend")
+	assert.NoError(suite.T(), BackupS3BucketEncrypted(src, dst, []string{suite.PublicKeyPath}, ""), "failed to back up bucket")
+
+	assert.NoError(suite.T(), verifyBackup(dst, suite.PrivateKey, "foo/bar/foobar.file1.c4gh"))
+
+	// replace the object with one that decrypts fine but holds other data
+	_, publicKeyList, err := getKeys([]string{suite.PublicKeyPath})
+	assert.NoError(suite.T(), err)
+	var buf bytes.Buffer
+	e, err := newEncryptor(publicKeyList, suite.PrivateKey, &buf)
+	assert.NoError(suite.T(), err)
+	_, err = e.Write([]byte("not the original data"))
+	assert.NoError(suite.T(), err)
+	assert.NoError(suite.T(), e.Close())
+	_, err = dst.Uploader.Upload(&s3manager.UploadInput{
+		Body:   &buf,
+		Bucket: aws.String(dst.Bucket),
+		Key:    aws.String("foo/bar/foobar.file1.c4gh"),
+	})
+	assert.NoError(suite.T(), err)
+
+	assert.ErrorContains(suite.T(), verifyBackup(dst, suite.PrivateKey, "foo/bar/foobar.file1.c4gh"), "does not match its manifest")
+}
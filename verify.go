@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mongoArchiveMagic starts every mongodump archive
+const mongoArchiveMagic uint32 = 0x8199e26d
+
+// verifyBackup proves that a backup can be restored without restoring it.
+// The object is decrypted and decompressed, its content is checked against
+// the format of its kind, and the checksum of the plaintext is compared
+// with the one in its manifest when there is one. The parts of an
+// Elasticsearch backup are verified as well.
+func verifyBackup(sb *s3Backend, privateKey [32]byte, name string) error {
+	if name == "" {
+		return fmt.Errorf("verify_backup needs the name of a backup")
+	}
+
+	if _, err := sb.checkKey(name, privateKey); err != nil {
+		return err
+	}
+
+	fr, err := sb.NewFileReader(name)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	dr, err := newDecryptor(privateKey, fr)
+	if err != nil {
+		return fmt.Errorf("could not initialise decryptor: %s", err)
+	}
+	defer dr.Close()
+
+	var plaintext io.Reader = dr
+	// objects of bucket backups are encrypted but not compressed
+	if path.Ext(name) != ".c4gh" {
+		d, err := newDecompressor(dr)
+		if err != nil {
+			return fmt.Errorf("%s is corrupt, could not initialise decompressor: %s", name, err)
+		}
+		defer d.Close()
+		plaintext = d
+	}
+
+	// everything read by the format checks is counted and hashed
+	measured := newMeasuredWriter(io.Discard, true)
+	r := io.TeeReader(plaintext, measured)
+
+	var (
+		detail string
+		parts  []string
+	)
+	switch ext := path.Ext(name); {
+	case ext == ".sqldump":
+		detail, err = verifyTar(r, "toc.dat")
+	case ext == ".enc":
+		detail, err = verifyTar(r, "PG_VERSION")
+	case ext == ".archive":
+		detail, err = verifyMongoArchive(r)
+	case ext == ".bup" || strings.Contains(name, ".bup.part-"):
+		detail, parts, err = verifyElasticBackup(r)
+	case ext == templatesSuffix:
+		detail, err = verifyTemplates(r)
+	case ext == ".c4gh":
+		detail = "encrypted bucket object"
+	default:
+		return fmt.Errorf("%s is not a known kind of backup", name)
+	}
+	if err == nil {
+		// read what the format check left, so that the whole object is
+		// decrypted and the checksum covers all of it
+		_, err = io.Copy(io.Discard, r)
+	}
+	if err != nil {
+		return fmt.Errorf("%s is corrupt at byte %d of the plaintext: %s", name, measured.n, err)
+	}
+
+	expected, err := sb.expectedChecksum(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case expected == "":
+		log.Warnf("%s has no checksum in a manifest, only the format was verified", name)
+	case expected != measured.sum():
+		return fmt.Errorf("%s does not match its manifest: plaintext sha256 is %s, expected %s", name, measured.sum(), expected)
+	}
+	log.Infof("%s verified: %s, %d bytes, sha256 %s", name, detail, measured.n, measured.sum())
+
+	for _, part := range parts {
+		if err := verifyBackup(sb, privateKey, part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expectedChecksum returns the plaintext checksum recorded for a backup, or
+// an empty string when no manifest records it. The objects of a bucket
+// backup are looked up in the bucket manifest of the closest prefix.
+func (sb *s3Backend) expectedChecksum(name string) (string, error) {
+	if path.Ext(name) != ".c4gh" {
+		if !sb.objectExists(name + manifestSuffix) {
+			return "", nil
+		}
+		manifest, err := sb.readManifest(name)
+		if err != nil {
+			return "", fmt.Errorf("could not read manifest of %s: %s", name, err)
+		}
+
+		return manifest.PlaintextSHA256, nil
+	}
+
+	source := strings.TrimSuffix(name, ".c4gh")
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		prefix := dir
+		if prefix == "." || prefix == "/" {
+			prefix = ""
+		}
+		manifest, err := sb.readBucketManifest("", prefix)
+		if err != nil {
+			return "", fmt.Errorf("could not read backup manifest of %s: %s", name, err)
+		}
+		if entry, ok := manifest.Objects[source]; ok {
+			return entry.PlaintextSHA256, nil
+		}
+		if prefix == "" {
+			return "", nil
+		}
+	}
+}
+
+// verifyTar reads every entry of a tar archive, which has to contain a file
+// with the given base name
+func verifyTar(r io.Reader, required string) (string, error) {
+	tr := tar.NewReader(r)
+	found := false
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if entries == 0 {
+				return "", fmt.Errorf("tar archive is empty")
+			}
+			if !found {
+				return "", fmt.Errorf("tar archive has no %s", required)
+			}
+
+			return fmt.Sprintf("tar archive with %d entries", entries), nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("tar header %d: %s", entries+1, err)
+		}
+		if path.Base(hdr.Name) == required {
+			found = true
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return "", fmt.Errorf("tar entry %d (%s): %s", entries+1, hdr.Name, err)
+		}
+	}
+}
+
+// verifyMongoArchive checks the magic number of a mongodump archive
+func verifyMongoArchive(r io.Reader) (string, error) {
+	var magic uint32
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
+		return "", fmt.Errorf("could not read archive magic number: %s", err)
+	}
+	if magic != mongoArchiveMagic {
+		return "", fmt.Errorf("archive magic number is %#x, expected %#x", magic, mongoArchiveMagic)
+	}
+
+	return "mongodump archive", nil
+}
+
+// verifyElasticBackup checks that the first line of an Elasticsearch backup
+// is either its header or a batch, and that all other lines are batches of
+// hits with an _id and a _source. The parts listed in the header are
+// returned.
+func verifyElasticBackup(r io.Reader) (string, []string, error) {
+	var (
+		parts   []string
+		batches int
+		docs    int
+	)
+
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		text = strings.TrimSpace(text)
+		switch {
+		case text == "":
+		case !gjson.Valid(text):
+			return "", nil, fmt.Errorf("line %d is not valid JSON", line)
+		case line == 1 && strings.HasPrefix(text, "{"):
+			header := backupHeader{}
+			if err := json.Unmarshal([]byte(text), &header); err != nil || header.Metadata == nil {
+				return "", nil, fmt.Errorf("line 1 is not a backup header")
+			}
+			parts = header.Parts
+		case strings.HasPrefix(text, "["):
+			for i, hit := range gjson.Parse(text).Array() {
+				if !hit.Get("_id").Exists() || !hit.Get("_source").Exists() {
+					return "", nil, fmt.Errorf("line %d, hit %d has no _id or _source", line, i+1)
+				}
+				docs++
+			}
+			batches++
+		default:
+			return "", nil, fmt.Errorf("line %d is not a batch of hits", line)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	detail := fmt.Sprintf("%d documents in %d batches", docs, batches)
+	if len(parts) > 0 {
+		detail += fmt.Sprintf(", %d parts", len(parts))
+	}
+
+	return detail, parts, nil
+}
+
+// verifyTemplates checks that a template backup can be parsed
+func verifyTemplates(r io.Reader) (string, error) {
+	templates := clusterTemplates{}
+	if err := json.NewDecoder(r).Decode(&templates); err != nil {
+		return "", fmt.Errorf("could not parse templates: %s", err)
+	}
+
+	return fmt.Sprintf("%d ILM policies, %d component templates and %d index templates",
+		len(templates.ILMPolicies), len(templates.ComponentTemplates), len(templates.IndexTemplates)), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyElasticBackup(t *testing.T) {
+	backup := `{"metadata":{"index":"test"},"parts":["test.bup.part-000"]}
+[{"_id":"1","_source":{"a":1}},{"_id":"2","_source":{"a":2}}]
+[{"_id":"3","_source":{"a":3}}]
+`
+	detail, parts, err := verifyElasticBackup(strings.NewReader(backup))
+	assert.NoError(t, err)
+	assert.Equal(t, "3 documents in 2 batches, 1 parts", detail)
+	assert.Equal(t, []string{"test.bup.part-000"}, parts)
+
+	_, _, err = verifyElasticBackup(strings.NewReader("[{\"_id\":\"1\",\"_source\":{}}]\n[{\"_id\":\"2\",\"_sour"))
+	assert.ErrorContains(t, err, "line 2 is not valid JSON")
+
+	_, _, err = verifyElasticBackup(strings.NewReader("[{\"_id\":\"1\"}]\n"))
+	assert.ErrorContains(t, err, "line 1, hit 1 has no _id or _source")
+}
+
+func TestVerifyTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"toc.dat", "3000.dat"} {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: 4}))
+		_, err := tw.Write([]byte("data"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+
+	detail, err := verifyTar(bytes.NewReader(buf.Bytes()), "toc.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, "tar archive with 2 entries", detail)
+
+	_, err = verifyTar(bytes.NewReader(buf.Bytes()), "PG_VERSION")
+	assert.ErrorContains(t, err, "has no PG_VERSION")
+
+	_, err = verifyTar(bytes.NewReader(buf.Bytes()[:514]), "toc.dat")
+	assert.Error(t, err)
+}
+
+func TestVerifyMongoArchive(t *testing.T) {
+	_, err := verifyMongoArchive(bytes.NewReader([]byte{0x6d, 0xe2, 0x99, 0x81, 0x00}))
+	assert.NoError(t, err)
+
+	_, err = verifyMongoArchive(bytes.NewReader([]byte("PGDMP")))
+	assert.ErrorContains(t, err, "magic number")
+}